@@ -11,8 +11,10 @@ import (
 	"github.com/rs/cors"
 	"github.com/sirupsen/logrus"
 	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/config"
 	"github.com/tongshengw/nimbus/backend/sectionleader/internal/handlers"
 	"github.com/tongshengw/nimbus/backend/sectionleader/internal/middle"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/store"
 )
 
 func main() {
@@ -30,23 +32,87 @@ func main() {
 		logrus.Fatalf("failed to load .env: %v", err)
 	}
 
-	vmManager := app.NewVMManager()
+	cfg, err := config.Load()
+	if err != nil {
+		logrus.Fatalf("failed to load config: %v", err)
+	}
+
+	db, err := store.Open(cfg.DbPath)
+	if err != nil {
+		logrus.Fatalf("failed to open store: %v", err)
+	}
+	defer db.Close()
+
+	vmManager, err := app.NewVMManager(cfg, db)
+	if err != nil {
+		logrus.Fatalf("failed to create vm manager: %v", err)
+	}
+	err = vmManager.InitForwarder()
+	if err != nil {
+		logrus.Fatalf("failed to set up port forwarding: %v", err)
+	}
+	err = vmManager.LoadFromStore()
+	if err != nil {
+		logrus.Fatalf("failed to load machines from store: %v", err)
+	}
+	report := vmManager.Reconcile()
+	fmt.Printf("Reconciled leftover resources: %s\n", report.String())
 	installSignalHandlers(vmManager)
+	vmManager.StartPool()
+	vmManager.StartIdleDetector()
+	vmManager.StartReaper()
 
 	mux := http.NewServeMux()
-	mux.Handle("POST /new-machine", http.HandlerFunc(handlers.NewMachine))
-	mux.Handle("POST /shutdown-all", http.HandlerFunc(handlers.ShutdownAll))
+	mux.Handle("POST /new-machine", middle.WithUser(http.HandlerFunc(handlers.NewMachine)))
+	mux.Handle("POST /register", http.HandlerFunc(handlers.Register))
+	mux.Handle("POST /login", http.HandlerFunc(handlers.Login))
+	mux.Handle("GET /me/machines", middle.CheckUser(http.HandlerFunc(handlers.MyMachines)))
+	mux.Handle("POST /me/machines/{machineId}/tokens", middle.CheckUser(http.HandlerFunc(handlers.MachineTokens)))
+	mux.Handle("POST /refresh-token", http.HandlerFunc(handlers.RefreshToken))
 	mux.Handle("GET /check-status", http.HandlerFunc(handlers.CheckStatus))
+	mux.Handle("GET /images", http.HandlerFunc(handlers.ListImages))
 
 	privateMux := http.NewServeMux()
-	privateMux.Handle("GET /ssh-key", http.HandlerFunc(handlers.SshKey))
-	privateMux.Handle("POST /stop-machine", http.HandlerFunc(handlers.StopMachine))
+	privateMux.Handle("GET /ssh-key", middle.RequireScope(middle.ScopeSshKeyRead, http.HandlerFunc(handlers.SshKey)))
+	privateMux.Handle("GET /status", middle.RequireScope(middle.ScopeMachineRead, http.HandlerFunc(handlers.MachineStatus)))
+	privateMux.Handle("POST /stop-machine", middle.RequireScope(middle.ScopeMachineStop, http.HandlerFunc(handlers.StopMachine)))
+	privateMux.Handle("POST /pause", middle.RequireScope(middle.ScopeMachineControl, http.HandlerFunc(handlers.PauseMachine)))
+	privateMux.Handle("POST /resume", middle.RequireScope(middle.ScopeMachineControl, http.HandlerFunc(handlers.ResumeMachine)))
+	privateMux.Handle("POST /wake", middle.RequireScope(middle.ScopeMachineControl, http.HandlerFunc(handlers.WakeMachine)))
+	privateMux.Handle("POST /renew", middle.RequireScope(middle.ScopeMachineControl, http.HandlerFunc(handlers.RenewMachine)))
+	privateMux.Handle("GET /ports", middle.RequireScope(middle.ScopeMachineRead, http.HandlerFunc(handlers.ListPorts)))
+	privateMux.Handle("POST /ports", middle.RequireScope(middle.ScopePortsWrite, http.HandlerFunc(handlers.ExposePort)))
+	privateMux.Handle("DELETE /ports/{guestPort}", middle.RequireScope(middle.ScopePortsWrite, http.HandlerFunc(handlers.UnexposePort)))
+	privateMux.Handle("POST /snapshots", middle.RequireScope(middle.ScopeMachineControl, http.HandlerFunc(handlers.CreateSnapshot)))
+	privateMux.Handle("POST /restore", middle.RequireScope(middle.ScopeMachineControl, http.HandlerFunc(handlers.RestoreSnapshot)))
+	privateMux.Handle("POST /tokens", middle.RequireScope(middle.ScopeTokensWrite, http.HandlerFunc(handlers.CreateToken)))
+	// revoking the calling token needs no scope, revoking another one checks it
+	privateMux.Handle("POST /revoke-token", http.HandlerFunc(handlers.RevokeToken))
 
 	mux.Handle("/private/", http.StripPrefix("/private", middle.CheckJwt(privateMux)))
 
+	// admin routes need an admin API key whose role allows them
+	adminMux := http.NewServeMux()
+	adminMux.Handle("GET /subnets", middle.CheckAdmin(app.RoleReadOnly, http.HandlerFunc(handlers.ListSubnets)))
+	adminMux.Handle("GET /machines", middle.CheckAdmin(app.RoleReadOnly, http.HandlerFunc(handlers.ListMachines)))
+	adminMux.Handle("POST /machines/{machineId}/stop", middle.CheckAdmin(app.RoleOperator, http.HandlerFunc(handlers.ForceStopMachine)))
+	adminMux.Handle("POST /shutdown-all", middle.CheckAdmin(app.RoleAdmin, http.HandlerFunc(handlers.ShutdownAll)))
+	adminMux.Handle("GET /keys", middle.CheckAdmin(app.RoleAdmin, http.HandlerFunc(handlers.ListAdminKeys)))
+	adminMux.Handle("POST /keys", middle.CheckAdmin(app.RoleAdmin, http.HandlerFunc(handlers.CreateAdminKey)))
+	adminMux.Handle("DELETE /keys/{keyId}", middle.CheckAdmin(app.RoleAdmin, http.HandlerFunc(handlers.DeleteAdminKey)))
+
+	mux.Handle("/admin/", http.StripPrefix("/admin", adminMux))
+
+	userAuth, err := middle.NewUserAuthenticators(cfg.Auth)
+	if err != nil {
+		logrus.Fatalf("failed to set up auth: %v", err)
+	}
+
 	commonContextData := middle.CommonContextData{
 		Manager:   vmManager,
-		SecretKey: os.Getenv("SECRET_KEY"),
+		SecretKey: cfg.SecretKey,
+		Tokens:    cfg.Tokens,
+		UserAuth:  userAuth,
 	}
 
 	splash := `
@@ -61,7 +127,7 @@ func main() {
 	corsHandler := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedHeaders: []string{"*"},
-		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "DELETE", "OPTIONS"},
 	}).Handler(mux)
 
 	logrus.Println("Starting server on :7212")
@@ -87,6 +153,7 @@ func installSignalHandlers(manager *app.VMManager) {
 			switch s := <-c; {
 			case s == syscall.SIGTERM || s == os.Interrupt:
 				logrus.Printf("Caught signal: %s, requesting clean shutdown", s.String())
+				manager.DrainPool()
 				err := manager.GracefulShutdownAll()
 				if err != nil {
 					logrus.Errorf("An error occurred while stopping Firecracker VMM: %v", err)
@@ -100,6 +167,7 @@ func installSignalHandlers(manager *app.VMManager) {
 				// if err := m.StopVMM(); err != nil {
 				// 	logrus.Errorf("An error occurred while stopping Firecracker VMM: %v", err)
 				// }
+				manager.DrainPool()
 				err := manager.GracefulShutdownAll()
 				if err != nil {
 					logrus.Errorf("An error occurred while stopping Firecracker VMM: %v", err)
@@ -0,0 +1,233 @@
+package app
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/store"
+)
+
+// AdminRole is what an admin API key may do. Each role may do everything the
+// roles after it may.
+type AdminRole string
+
+const (
+	RoleAdmin    AdminRole = "admin"     // everything, including managing keys
+	RoleOperator AdminRole = "operator"  // stop machines
+	RoleReadOnly AdminRole = "read-only" // list machines and subnets
+)
+
+var adminRoles = []AdminRole{RoleAdmin, RoleOperator, RoleReadOnly}
+
+const adminKeyPrefix = "nimbus_"
+
+var (
+	ErrInvalidRole      = errors.New("roles are admin, operator and read-only")
+	ErrInvalidKeyName   = errors.New("key names are 1 to 64 characters")
+	ErrAdminKeyNotFound = errors.New("admin key does not exist")
+	ErrInvalidAdminKey  = errors.New("invalid admin key")
+)
+
+func (r AdminRole) valid() bool {
+	return slices.Contains(adminRoles, r)
+}
+
+// Allows reports whether a key with role r may do what needs role required.
+func (r AdminRole) Allows(required AdminRole) bool {
+	i := slices.Index(adminRoles, r)
+	return i != -1 && i <= slices.Index(adminRoles, required)
+}
+
+// AdminKey is an admin API key. Only the sha256 of the key is kept, the key
+// itself is shown once when it is created.
+type AdminKey struct {
+	Id           string    `json:"id"`
+	Name         string    `json:"name"`
+	Role         AdminRole `json:"role"`
+	Hash         string    `json:"hash"`
+	CreationTime time.Time `json:"creation_time"`
+}
+
+// AdminKeyRegistry holds the admin API keys and writes them to the store.
+type AdminKeyRegistry struct {
+	mutex  sync.Mutex
+	byId   map[string]*AdminKey
+	byHash map[string]string
+	store  *store.Store
+	// key from the config, not stored and not listed
+	bootstrap *AdminKey
+}
+
+func NewAdminKeyRegistry(db *store.Store, bootstrapKey string) *AdminKeyRegistry {
+	r := &AdminKeyRegistry{
+		byId:   make(map[string]*AdminKey),
+		byHash: make(map[string]string),
+		store:  db,
+	}
+	if bootstrapKey != "" {
+		r.bootstrap = &AdminKey{
+			Id:   "bootstrap",
+			Name: "ADMIN_API_KEY",
+			Role: RoleAdmin,
+			Hash: hashAdminKey(bootstrapKey),
+		}
+	}
+	return r
+}
+
+// Create makes a new key with the given role, and returns it with the key
+// itself.
+func (r *AdminKeyRegistry) Create(name string, role AdminRole) (AdminKey, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 64 {
+		return AdminKey{}, "", ErrInvalidKeyName
+	}
+	if !role.valid() {
+		return AdminKey{}, "", ErrInvalidRole
+	}
+
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return AdminKey{}, "", err
+	}
+	plain := adminKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	key := &AdminKey{
+		Id:           uuid.NewString(),
+		Name:         name,
+		Role:         role,
+		Hash:         hashAdminKey(plain),
+		CreationTime: time.Now(),
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	err = r.persist(key)
+	if err != nil {
+		return AdminKey{}, "", err
+	}
+	r.byId[key.Id] = key
+	r.byHash[key.Hash] = key.Id
+
+	logrus.Infof("created admin key %s (%s, %s)", key.Id, name, role)
+	return *key, plain, nil
+}
+
+// Authenticate returns the key matching plain, and ErrInvalidAdminKey if none
+// does.
+func (r *AdminKeyRegistry) Authenticate(plain string) (AdminKey, error) {
+	if plain == "" {
+		return AdminKey{}, ErrInvalidAdminKey
+	}
+	// keys are random, so looking up their hash gives nothing away about
+	// other keys
+	hash := hashAdminKey(plain)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.bootstrap != nil && r.bootstrap.Hash == hash {
+		return *r.bootstrap, nil
+	}
+	id, ok := r.byHash[hash]
+	if !ok {
+		return AdminKey{}, ErrInvalidAdminKey
+	}
+	return *r.byId[id], nil
+}
+
+// List returns the stored keys, oldest first.
+func (r *AdminKeyRegistry) List() []AdminKey {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	keys := make([]AdminKey, 0, len(r.byId))
+	for _, key := range r.byId {
+		keys = append(keys, *key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreationTime.Before(keys[j].CreationTime)
+	})
+	return keys
+}
+
+// Delete revokes the key with the given id.
+func (r *AdminKeyRegistry) Delete(id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	key, ok := r.byId[id]
+	if !ok {
+		return ErrAdminKeyNotFound
+	}
+	if r.store != nil {
+		err := r.store.Delete(store.BucketAdminKeys, id)
+		if err != nil {
+			return err
+		}
+	}
+	delete(r.byId, id)
+	delete(r.byHash, key.Hash)
+
+	logrus.Infof("deleted admin key %s (%s)", id, key.Name)
+	return nil
+}
+
+// Load restores the keys recorded in the store.
+func (r *AdminKeyRegistry) Load() error {
+	if r.store == nil {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	values, err := r.store.List(store.BucketAdminKeys)
+	if err != nil {
+		return err
+	}
+
+	for id, value := range values {
+		var key AdminKey
+		err = json.Unmarshal(value, &key)
+		if err != nil {
+			logrus.Errorf("skipping malformed admin key record %s: %v", id, err)
+			continue
+		}
+		r.byId[key.Id] = &key
+		r.byHash[key.Hash] = key.Id
+	}
+
+	return nil
+}
+
+// persist must be called with r.mutex held.
+func (r *AdminKeyRegistry) persist(key *AdminKey) error {
+	if r.store == nil {
+		return nil
+	}
+
+	value, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return r.store.Put(store.BucketAdminKeys, key.Id, value)
+}
+
+func hashAdminKey(plain string) string {
+	sum := sha256.Sum256([]byte(plain))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAdminRoleAllows(t *testing.T) {
+	tests := []struct {
+		role     AdminRole
+		required AdminRole
+		want     bool
+	}{
+		{RoleAdmin, RoleAdmin, true},
+		{RoleAdmin, RoleOperator, true},
+		{RoleAdmin, RoleReadOnly, true},
+		{RoleOperator, RoleAdmin, false},
+		{RoleOperator, RoleOperator, true},
+		{RoleOperator, RoleReadOnly, true},
+		{RoleReadOnly, RoleAdmin, false},
+		{RoleReadOnly, RoleOperator, false},
+		{RoleReadOnly, RoleReadOnly, true},
+		{"root", RoleReadOnly, false},
+		{"", RoleReadOnly, false},
+		{RoleAdmin, "root", false},
+	}
+	for _, tt := range tests {
+		got := tt.role.Allows(tt.required)
+		if got != tt.want {
+			t.Errorf("%q.Allows(%q) = %v, want %v", tt.role, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestAdminKeyLifecycle(t *testing.T) {
+	registry := NewAdminKeyRegistry(nil, "bootstrap-key")
+
+	key, plain, err := registry.Create("  ci  ", RoleOperator)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if !strings.HasPrefix(plain, adminKeyPrefix) || key.Name != "ci" || key.Role != RoleOperator {
+		t.Fatalf("unexpected key %+v, %q", key, plain)
+	}
+	if key.Hash == "" || strings.Contains(key.Hash, plain) {
+		t.Fatalf("key is not stored hashed: %q", key.Hash)
+	}
+
+	found, err := registry.Authenticate(plain)
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	if found.Id != key.Id {
+		t.Fatalf("authenticated as %s, want %s", found.Id, key.Id)
+	}
+
+	bootstrap, err := registry.Authenticate("bootstrap-key")
+	if err != nil || bootstrap.Role != RoleAdmin {
+		t.Fatalf("bootstrap key: %+v, %v", bootstrap, err)
+	}
+	if len(registry.List()) != 1 {
+		t.Fatalf("listed %d keys, want only the created one", len(registry.List()))
+	}
+
+	err = registry.Delete(key.Id)
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	err = registry.Delete(key.Id)
+	if !errors.Is(err, ErrAdminKeyNotFound) {
+		t.Fatalf("second delete error = %v, want ErrAdminKeyNotFound", err)
+	}
+
+	for name, plain := range map[string]string{
+		"deleted key": plain,
+		"wrong key":   adminKeyPrefix + "wrong",
+		"empty key":   "",
+	} {
+		_, err := registry.Authenticate(plain)
+		if !errors.Is(err, ErrInvalidAdminKey) {
+			t.Errorf("%s: error = %v, want ErrInvalidAdminKey", name, err)
+		}
+	}
+}
+
+func TestAdminKeyCreateInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		keyName string
+		role    AdminRole
+		want    error
+	}{
+		{name: "empty name", keyName: " ", role: RoleAdmin, want: ErrInvalidKeyName},
+		{name: "long name", keyName: strings.Repeat("a", 65), role: RoleAdmin, want: ErrInvalidKeyName},
+		{name: "unknown role", keyName: "ci", role: "root", want: ErrInvalidRole},
+		{name: "no role", keyName: "ci", want: ErrInvalidRole},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := NewAdminKeyRegistry(nil, "")
+			_, _, err := registry.Create(tt.keyName, tt.role)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package app
+
+import (
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/images"
+)
+
+// ResolveImage looks up a catalog image, the default image if name is empty.
+// An unknown name is an images.ErrImageNotFound.
+func (manager *VMManager) ResolveImage(name string) (images.Image, error) {
+	if name == "" {
+		name = manager.cfg.DefaultImage
+	}
+	return manager.images.Get(name)
+}
+
+func (manager *VMManager) Images() []images.Image {
+	return manager.images.List()
+}
@@ -1,14 +1,12 @@
 package app
 
 import (
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"net"
 	"os"
 
 	"github.com/sirupsen/logrus"
-	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
 )
 
 const CniConfRootDir = "/etc/cni/conf.d"
@@ -34,25 +32,10 @@ type CNIConfig struct {
 	Plugins    []Plugin `json:"plugins"`
 }
 
-var nextSubnet net.IP = net.ParseIP(constants.CniFirstSubnetStr).To4()
-
-// returns name of the config generated
-func GenerateCniConfFile(id MachineUUID) (string, error) {
+// GenerateCniConfFile writes a conflist giving the VM the given /30, returns
+// the name of the network
+func GenerateCniConfFile(id MachineUUID, subnet *net.IPNet) (string, error) {
 	vmID := id.String()
-	if nextSubnet.Equal(net.ParseIP(constants.CniLastSubnetStr).To4()) {
-		return "", fmt.Errorf("ran out of subnet IDs")
-	}
-	
-	subnet := nextSubnet.String() + "/30"
-
-	if nextSubnet.To4() == nil {
-		return "", fmt.Errorf("malformed next subnet ip")
-	}
-	subnetInt := binary.BigEndian.Uint32(nextSubnet.To4())
-	binary.BigEndian.PutUint32(nextSubnet, subnetInt + 4)
-
-	// FIXME:
-	logrus.Infof("HERE: %s", nextSubnet.String())
 
 	config := CNIConfig{
 		CNIVersion: "0.4.0",
@@ -62,7 +45,7 @@ func GenerateCniConfFile(id MachineUUID) (string, error) {
 				Type: "ptp",
 				IPAM: &IPAM{
 					Type:   "host-local",
-					Subnet: subnet,
+					Subnet: subnet.String(),
 					Routes: []Route{
 						{Dst: "0.0.0.0/0"},
 					},
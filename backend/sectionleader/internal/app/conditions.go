@@ -0,0 +1,97 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
+)
+
+const (
+	// ConditionIngressReady is true once everything published for the machine
+	// is reachable from outside.
+	ConditionIngressReady = "IngressReady"
+)
+
+// MachineCondition is an observation about a machine that is not part of its
+// state, such as ingress proxies that failed to start.
+type MachineCondition struct {
+	Type               string    `json:"type"`
+	Status             bool      `json:"status"`
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"last_transition_time"`
+}
+
+// setCondition replaces the condition of the same type, keeping the
+// transition time if the status did not change.
+func setCondition(data *MachineData, condition MachineCondition) {
+	condition.LastTransitionTime = time.Now()
+	for i, c := range data.Conditions {
+		if c.Type != condition.Type {
+			continue
+		}
+		if c.Status == condition.Status {
+			condition.LastTransitionTime = c.LastTransitionTime
+		}
+		data.Conditions[i] = condition
+		return
+	}
+	data.Conditions = append(data.Conditions, condition)
+}
+
+// waitIngress waits for the ingress of a published machine to come up and
+// records the outcome as the IngressReady condition. It must be called
+// without manager.mutex held, and returns the updated machine data, or
+// ErrMachineNotFound if the machine was deleted in the meantime.
+func (manager *VMManager) waitIngress(id MachineUUID) (MachineData, error) {
+	manager.mutex.Lock()
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		manager.mutex.Unlock()
+		return MachineData{}, ErrMachineNotFound
+	}
+	data := vmPtr.data
+	manager.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), constants.IngressReadyTimeout)
+	defer cancel()
+	err := manager.ingress.WaitReady(ctx, data)
+
+	condition := MachineCondition{Type: ConditionIngressReady, Status: true, Reason: "Ready"}
+	var notReady *IngressNotReadyError
+	if errors.As(err, &notReady) {
+		condition = MachineCondition{Type: ConditionIngressReady, Reason: "ProxiesNotRunning", Message: err.Error()}
+	} else if err != nil {
+		condition = MachineCondition{Type: ConditionIngressReady, Reason: "StatusUnavailable", Message: err.Error()}
+	}
+	if !condition.Status {
+		logrus.Warnf("ingress of machine %s not ready: %s", id.String(), condition.Message)
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok = manager.VMs[id]
+	if !ok {
+		return MachineData{}, ErrMachineNotFound
+	}
+	setCondition(&vmPtr.data, condition)
+	manager.persist(vmPtr)
+	return vmPtr.data, nil
+}
+
+// MachineStatus returns the state and the data, including the conditions, of
+// a machine.
+func (manager *VMManager) MachineStatus(id MachineUUID) (VMState, MachineData, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		return 0, MachineData{}, ErrMachineNotFound
+	}
+	return vmPtr.State, vmPtr.data, nil
+}
@@ -32,4 +32,7 @@ var (
 
 	// error with firecracker config
 	// errInvalidMetadata = errors.New("invalid metadata, unable to parse as json")
-)
\ No newline at end of file
+)
+var (
+	ErrMachineNotFound = errors.New("machine does not exist")
+)
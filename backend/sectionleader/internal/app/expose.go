@@ -0,0 +1,186 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
+)
+
+// most guest ports a single machine may expose, including the default game
+// port
+const maxExposedPorts = 10
+
+var (
+	ErrPortAlreadyExposed = errors.New("guest port is already exposed")
+	ErrPortNotExposed     = errors.New("guest port is not exposed")
+	ErrTooManyPorts       = fmt.Errorf("a machine can expose at most %d ports", maxExposedPorts)
+	ErrMachineNotRunning  = errors.New("machine is not running")
+)
+
+// ExposedPort is a guest port reachable from outside. Traffic to the public
+// port reaches HostPort through frp, and is DNATed from there to the guest.
+type ExposedPort struct {
+	GuestPort  int      `json:"guest_port"`
+	Protocol   Protocol `json:"protocol"`
+	HostPort   int      `json:"host_port"`
+	PublicPort int      `json:"public_port"`
+}
+
+// ExposePort allocates a host and a public port for a guest port of a running
+// machine, installs the forwarding rules and publishes it through the ingress
+// provider. Whether the ingress came up is reported in the IngressReady
+// condition of the returned data.
+func (manager *VMManager) ExposePort(id MachineUUID, protocol Protocol, guestPort int) (ExposedPort, MachineData, error) {
+	exposed, err := manager.exposeAndPublish(id, protocol, guestPort)
+	if err != nil {
+		return ExposedPort{}, MachineData{}, err
+	}
+	data, err := manager.waitIngress(id)
+	if err != nil {
+		return ExposedPort{}, MachineData{}, err
+	}
+	return exposed, data, nil
+}
+
+func (manager *VMManager) exposeAndPublish(id MachineUUID, protocol Protocol, guestPort int) (ExposedPort, error) {
+	if guestPort < 1 || guestPort > 65535 || (guestPort == 22 && protocol == ProtocolTCP) {
+		return ExposedPort{}, fmt.Errorf("invalid guest port %d", guestPort)
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		return ExposedPort{}, ErrMachineNotFound
+	}
+	if vmPtr.State == StateStopped {
+		return ExposedPort{}, ErrMachineNotRunning
+	}
+	if vmPtr.State == StateHibernated {
+		return ExposedPort{}, ErrMachineHibernated
+	}
+
+	previous := vmPtr.data
+	exposed, err := manager.exposePort(vmPtr, protocol, guestPort)
+	if err != nil {
+		return ExposedPort{}, err
+	}
+
+	err = manager.publish(vmPtr)
+	if err != nil {
+		vmPtr.data = previous
+		manager.applyForwarding(vmPtr, vmPtr.data.ExposedPorts)
+		manager.ports.Release(PortPoolForward, exposed.HostPort)
+		manager.ports.Release(PortPoolGame, exposed.PublicPort)
+		return ExposedPort{}, err
+	}
+
+	manager.persist(vmPtr)
+	return exposed, nil
+}
+
+// exposePort must be called with manager.mutex held.
+func (manager *VMManager) exposePort(vmPtr *VM, protocol Protocol, guestPort int) (ExposedPort, error) {
+	for _, p := range vmPtr.data.ExposedPorts {
+		if p.GuestPort == guestPort && p.Protocol == protocol {
+			return ExposedPort{}, ErrPortAlreadyExposed
+		}
+	}
+	if len(vmPtr.data.ExposedPorts) >= maxExposedPorts {
+		return ExposedPort{}, ErrTooManyPorts
+	}
+
+	hostPort, err := manager.ports.Allocate(PortPoolForward, protocol, vmPtr.Id)
+	if err != nil {
+		return ExposedPort{}, err
+	}
+
+	publicPort, err := manager.ports.Allocate(PortPoolGame, protocol, vmPtr.Id)
+	if err != nil {
+		manager.ports.Release(PortPoolForward, hostPort)
+		return ExposedPort{}, err
+	}
+
+	exposed := ExposedPort{GuestPort: guestPort, Protocol: protocol, HostPort: hostPort, PublicPort: publicPort}
+	ports := append(append([]ExposedPort{}, vmPtr.data.ExposedPorts...), exposed)
+	err = manager.applyForwarding(vmPtr, ports)
+	if err != nil {
+		manager.ports.Release(PortPoolForward, hostPort)
+		manager.ports.Release(PortPoolGame, publicPort)
+		return ExposedPort{}, err
+	}
+
+	vmPtr.data.ExposedPorts = ports
+	if guestPort == constants.InternalGamePort && protocol == ProtocolTCP {
+		vmPtr.data.LocalPort = hostPort
+		vmPtr.data.GameRemotePort = publicPort
+	}
+
+	logrus.Infof("exposed %s port %d of machine %s on host port %d, public port %d",
+		protocol, guestPort, vmPtr.Id.String(), hostPort, publicPort)
+	return exposed, nil
+}
+
+// UnexposePort removes the forwarding of a guest port, republishes the machine
+// and releases the ports.
+func (manager *VMManager) UnexposePort(id MachineUUID, protocol Protocol, guestPort int) (MachineData, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		return MachineData{}, ErrMachineNotFound
+	}
+	if vmPtr.State == StateHibernated {
+		return MachineData{}, ErrMachineHibernated
+	}
+
+	for i, p := range vmPtr.data.ExposedPorts {
+		if p.GuestPort != guestPort || p.Protocol != protocol {
+			continue
+		}
+
+		ports := append(vmPtr.data.ExposedPorts[:i:i], vmPtr.data.ExposedPorts[i+1:]...)
+		if vmPtr.State != StateStopped {
+			err := manager.applyForwarding(vmPtr, ports)
+			if err != nil {
+				return MachineData{}, err
+			}
+		}
+		manager.ports.Release(PortPoolForward, p.HostPort)
+		manager.ports.Release(PortPoolGame, p.PublicPort)
+
+		vmPtr.data.ExposedPorts = ports
+		if guestPort == constants.InternalGamePort && protocol == ProtocolTCP {
+			vmPtr.data.LocalPort = 0
+			vmPtr.data.GameRemotePort = 0
+		}
+		if vmPtr.State != StateStopped {
+			err := manager.publish(vmPtr)
+			if err != nil {
+				logrus.Errorf("failed to republish machine %s: %v", id.String(), err)
+			}
+		}
+
+		manager.persist(vmPtr)
+		logrus.Infof("unexposed %s port %d of machine %s", protocol, guestPort, id.String())
+		return vmPtr.data, nil
+	}
+
+	return MachineData{}, ErrPortNotExposed
+}
+
+func (manager *VMManager) ListPorts(id MachineUUID) ([]ExposedPort, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		return nil, ErrMachineNotFound
+	}
+
+	return append([]ExposedPort{}, vmPtr.data.ExposedPorts...), nil
+}
@@ -0,0 +1,131 @@
+package app
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
+)
+
+const (
+	ForwarderIptables = "iptables"
+	ForwarderNftables = "nftables"
+)
+
+// PortMapping forwards HostPort on the host to GuestPort of the VM at VMIp.
+type PortMapping struct {
+	Protocol  Protocol
+	HostPort  int
+	VMIp      net.IP
+	GuestPort int
+}
+
+// Forwarder installs the host rules that forward host ports into VMs. All
+// mappings of a VM are replaced at once, so a failed call leaves the previous
+// set of mappings in place.
+type Forwarder interface {
+	// Name is the backend name used in logs and in the config
+	Name() string
+
+	// Init prepares whatever host state the backend needs, it is called once
+	// at startup and must keep the mappings of a previous run.
+	Init() error
+
+	// Apply replaces every mapping pointing at vmIP with mappings, an empty
+	// set removes all of them.
+	Apply(vmIP net.IP, mappings []PortMapping) error
+
+	// List returns every mapping currently installed on the host.
+	List() ([]PortMapping, error)
+}
+
+func NewForwarder(backend string) (Forwarder, error) {
+	switch backend {
+	case ForwarderIptables:
+		return &iptablesForwarder{}, nil
+	case ForwarderNftables:
+		return &nftablesForwarder{}, nil
+	}
+	return nil, fmt.Errorf("unknown forwarder %q", backend)
+}
+
+// checkMappings validates mappings before a backend applies them.
+func checkMappings(vmIP net.IP, mappings []PortMapping) error {
+	if vmIP.To4() == nil {
+		return fmt.Errorf("vm ip %s is not ipv4", vmIP)
+	}
+	for _, m := range mappings {
+		if !m.VMIp.Equal(vmIP) {
+			return fmt.Errorf("mapping of port %d points at %s, not %s", m.HostPort, m.VMIp, vmIP)
+		}
+		if m.Protocol != ProtocolTCP && m.Protocol != ProtocolUDP {
+			return fmt.Errorf("unsupported protocol %q", m.Protocol)
+		}
+		if !allowedHostPort(m.HostPort) {
+			return fmt.Errorf("host port %d outside the allowed ranges", m.HostPort)
+		}
+		if m.GuestPort < 1 || m.GuestPort > 65535 {
+			return fmt.Errorf("invalid guest port %d", m.GuestPort)
+		}
+	}
+	return nil
+}
+
+// allowedHostPort accepts the local forward ports, and the ssh and public
+// ports which are forwarded by the direct ingress.
+func allowedHostPort(port int) bool {
+	return (port >= constants.MinLocalForwardPort && port <= constants.MaxLocalForwardPort) ||
+		(port >= constants.MinRemotePort && port <= constants.MaxRemotePort) ||
+		(port >= constants.MinGameRemotePort && port <= constants.MaxGameRemotePort)
+}
+
+// InitForwarder prepares the forwarding backend, it must run before
+// LoadFromStore and Reconcile.
+func (manager *VMManager) InitForwarder() error {
+	err := manager.forwarder.Init()
+	if err != nil {
+		return fmt.Errorf("init %s forwarder: %v", manager.forwarder.Name(), err)
+	}
+	logrus.Infof("using %s port forwarding", manager.forwarder.Name())
+	return nil
+}
+
+// applyForwarding installs the given exposed ports, and whatever the ingress
+// provider needs for them, as the complete set of mappings of the VM.
+func (manager *VMManager) applyForwarding(vmPtr *VM, ports []ExposedPort) error {
+	ip := vmPtr.data.LocalIp.IP
+	err := manager.forwarder.Apply(ip, manager.forwardingMappings(vmPtr, ports))
+	if err != nil {
+		return fmt.Errorf("%s forwarding for %s: %v", manager.forwarder.Name(), ip, err)
+	}
+	return nil
+}
+
+// forwardingMappings are the mappings applyForwarding installs for ports.
+func (manager *VMManager) forwardingMappings(vmPtr *VM, ports []ExposedPort) []PortMapping {
+	ip := vmPtr.data.LocalIp.IP
+	var mappings []PortMapping
+	for _, p := range ports {
+		mappings = append(mappings, PortMapping{
+			Protocol:  p.Protocol,
+			HostPort:  p.HostPort,
+			VMIp:      ip,
+			GuestPort: p.GuestPort,
+		})
+	}
+	data := vmPtr.data
+	data.ExposedPorts = ports
+	return append(mappings, manager.ingress.Mappings(data)...)
+}
+
+// cleanupAllForwarding removes every mapping of the VM, must be called with
+// manager.mutex held.
+func (manager *VMManager) cleanupAllForwarding(vmPtr *VM) error {
+	ip := vmPtr.data.LocalIp.IP
+	err := manager.forwarder.Apply(ip, nil)
+	if err != nil {
+		return fmt.Errorf("%s forwarding for %s: %v", manager.forwarder.Name(), ip, err)
+	}
+	return nil
+}
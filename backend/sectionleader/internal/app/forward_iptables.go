@@ -0,0 +1,299 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// iptablesForwarder installs four rules per mapping in the builtin chains:
+// OUTPUT and PREROUTING DNAT, FORWARD ACCEPT and POSTROUTING MASQUERADE. A VM
+// is updated with a single iptables-restore --noflush, so the old rules are
+// removed and the new ones added in one commit per table.
+type iptablesForwarder struct{}
+
+func (f *iptablesForwarder) Name() string {
+	return ForwarderIptables
+}
+
+func (f *iptablesForwarder) Init() error {
+	_, err := exec.LookPath("iptables-restore")
+	return err
+}
+
+func (f *iptablesForwarder) Apply(vmIP net.IP, mappings []PortMapping) error {
+	err := checkMappings(vmIP, mappings)
+	if err != nil {
+		return err
+	}
+
+	tables := map[string][]string{}
+	for _, table := range []string{"nat", "filter"} {
+		rules, err := iptablesRules(table)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			ip := nimbusRuleVMIp(rule, vmIP.Equal)
+			if ip == nil {
+				continue
+			}
+			rule[0] = "-D"
+			tables[table] = append(tables[table], strings.Join(rule, " "))
+		}
+	}
+
+	// the FORWARD and POSTROUTING rules of host ports pointing at the same
+	// guest port are the same, they are only added once
+	added := map[string]bool{}
+	for _, m := range mappings {
+		for _, r := range portForwardingRules(m) {
+			line := strings.Join(r.args, " ")
+			if added[r.table+line] {
+				continue
+			}
+			added[r.table+line] = true
+			tables[r.table] = append(tables[r.table], line)
+		}
+	}
+
+	var input bytes.Buffer
+	for _, table := range []string{"nat", "filter"} {
+		if len(tables[table]) == 0 {
+			continue
+		}
+		fmt.Fprintf(&input, "*%s\n", table)
+		for _, line := range tables[table] {
+			fmt.Fprintln(&input, line)
+		}
+		fmt.Fprintln(&input, "COMMIT")
+	}
+	if input.Len() == 0 {
+		return nil
+	}
+
+	cmd := exec.Command("iptables-restore", "--noflush")
+	cmd.Stdin = &input
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables-restore failed: %v, output: %s", err, output)
+	}
+
+	logrus.Infof("applied %d iptables mappings for %s", len(mappings), vmIP)
+	return nil
+}
+
+// List rebuilds the mappings from the installed rules, one per PREROUTING
+// rule, keyed by host port since several host ports can point at one guest
+// port. A FORWARD or POSTROUTING rule left without any DNAT rule is still
+// listed, with HostPort 0, so that it can be cleaned up.
+func (f *iptablesForwarder) List() ([]PortMapping, error) {
+	type hostKey struct {
+		protocol Protocol
+		hostPort int
+	}
+	type backendKey struct {
+		protocol  Protocol
+		ip        string
+		guestPort int
+	}
+	var mappings []PortMapping
+	seen := map[hostKey]bool{}
+	backends := map[backendKey]bool{}
+	var leftovers []PortMapping
+
+	for _, table := range []string{"nat", "filter"} {
+		rules, err := iptablesRules(table)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			m, ok := parseForwardingRule(rule)
+			if !ok {
+				continue
+			}
+			if m.HostPort == 0 {
+				leftovers = append(leftovers, m)
+				continue
+			}
+			k := hostKey{m.Protocol, m.HostPort}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			backends[backendKey{m.Protocol, m.VMIp.String(), m.GuestPort}] = true
+			mappings = append(mappings, m)
+		}
+	}
+
+	for _, m := range leftovers {
+		k := backendKey{m.Protocol, m.VMIp.String(), m.GuestPort}
+		if backends[k] {
+			continue
+		}
+		backends[k] = true
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+func iptablesRules(table string) ([][]string, error) {
+	output, err := exec.Command("iptables", "-t", table, "-S").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("iptables -t %s -S failed: %v, output: %s", table, err, output)
+	}
+
+	var rules [][]string
+	for _, line := range strings.Split(string(output), "\n") {
+		rule := strings.Fields(line)
+		if len(rule) > 0 {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+type iptablesRule struct {
+	table string
+	args  []string
+}
+
+// portForwardingRules builds the iptables-restore lines of one mapping
+func portForwardingRules(m PortMapping) []iptablesRule {
+	protocol := string(m.Protocol)
+	destination := fmt.Sprintf("%s:%d", m.VMIp.String(), m.GuestPort)
+
+	// DNAT rule: redirect traffic to localhost:localPort to the VM
+	dnatRule := []string{
+		"-A", "OUTPUT",
+		"-p", protocol,
+		"--dport", strconv.Itoa(m.HostPort),
+		"-d", "127.0.0.1",
+		"-j", "DNAT",
+		"--to-destination", destination,
+	}
+
+	// Forward traffic from external interfaces to VM
+	prerouting := []string{
+		"-A", "PREROUTING",
+		"-p", protocol,
+		"--dport", strconv.Itoa(m.HostPort),
+		"-j", "DNAT",
+		"--to-destination", destination,
+	}
+
+	// Allow forwarding in FORWARD chain
+	forwardRule := []string{
+		"-A", "FORWARD",
+		"-p", protocol,
+		"-d", m.VMIp.String(),
+		"--dport", strconv.Itoa(m.GuestPort),
+		"-j", "ACCEPT",
+	}
+
+	// SNAT for return traffic
+	snatRule := []string{
+		"-A", "POSTROUTING",
+		"-p", protocol,
+		"-s", m.VMIp.String(),
+		"--sport", strconv.Itoa(m.GuestPort),
+		"-j", "MASQUERADE",
+	}
+
+	return []iptablesRule{
+		{"nat", dnatRule},
+		{"nat", prerouting},
+		{"filter", forwardRule},
+		{"nat", snatRule},
+	}
+}
+
+// parseForwardingRule reads a mapping back from one rule in iptables -S
+// form. Only PREROUTING rules carry the host port.
+func parseForwardingRule(rule []string) (PortMapping, bool) {
+	if nimbusRuleVMIp(rule, func(net.IP) bool { return true }) == nil {
+		return PortMapping{}, false
+	}
+
+	var m PortMapping
+	var dport, sport int
+	for i := 0; i+1 < len(rule); i++ {
+		switch rule[i] {
+		case "-p":
+			m.Protocol = Protocol(rule[i+1])
+		case "--dport":
+			dport, _ = strconv.Atoi(rule[i+1])
+		case "--sport":
+			sport, _ = strconv.Atoi(rule[i+1])
+		case "--to-destination":
+			host, port, err := net.SplitHostPort(rule[i+1])
+			if err == nil {
+				m.VMIp = net.ParseIP(host)
+				m.GuestPort, _ = strconv.Atoi(port)
+			}
+		case "-d", "-s":
+			if ip, _, err := net.ParseCIDR(rule[i+1]); err == nil && m.VMIp == nil {
+				m.VMIp = ip
+			}
+		}
+	}
+
+	switch rule[1] {
+	case "PREROUTING":
+		m.HostPort = dport
+	case "FORWARD":
+		m.GuestPort = dport
+	case "POSTROUTING":
+		m.GuestPort = sport
+	default:
+		// the OUTPUT rule duplicates the PREROUTING one
+		return PortMapping{}, false
+	}
+
+	if m.VMIp == nil || m.GuestPort == 0 || (m.Protocol != ProtocolTCP && m.Protocol != ProtocolUDP) {
+		return PortMapping{}, false
+	}
+	return m, true
+}
+
+// nimbusRuleVMIp returns the VM ip of a rule installed by portForwardingRules,
+// or nil if the rule is not one of ours. Ours are port rules in the builtin
+// chains that point at an address accepted by match.
+func nimbusRuleVMIp(rule []string, match func(net.IP) bool) net.IP {
+	if len(rule) < 2 || rule[0] != "-A" {
+		return nil
+	}
+	switch rule[1] {
+	case "OUTPUT", "PREROUTING", "FORWARD", "POSTROUTING":
+	default:
+		return nil
+	}
+
+	var ip net.IP
+	hasPort := false
+	for i := 0; i+1 < len(rule); i++ {
+		switch rule[i] {
+		case "--to-destination":
+			host, _, err := net.SplitHostPort(rule[i+1])
+			if err == nil {
+				ip = net.ParseIP(host)
+			}
+		case "-d", "-s":
+			if parsed, _, err := net.ParseCIDR(rule[i+1]); err == nil && match(parsed) {
+				ip = parsed
+			}
+		case "--dport", "--sport":
+			hasPort = true
+		}
+	}
+
+	if !hasPort || ip == nil || !match(ip) {
+		return nil
+	}
+	return ip
+}
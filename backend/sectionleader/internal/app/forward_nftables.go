@@ -0,0 +1,201 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const nftTable = "nimbus"
+
+// nftablesRuleset creates the nimbus table. The rules never change, the
+// mappings live in the fwd_* maps and the backends set, so a VM is updated
+// by adding and deleting elements. Chains are flushed and re-added so Init
+// can run on every start without duplicating rules or losing elements.
+//
+// Note that the forward chain only accepts, a drop policy in another table
+// still applies.
+const nftablesRuleset = `add table ip nimbus
+add map ip nimbus fwd_tcp { type inet_service : ipv4_addr . inet_service; }
+add map ip nimbus fwd_udp { type inet_service : ipv4_addr . inet_service; }
+add set ip nimbus backends { type inet_proto . ipv4_addr . inet_service; }
+add chain ip nimbus prerouting { type nat hook prerouting priority -100; policy accept; }
+add chain ip nimbus output { type nat hook output priority -100; policy accept; }
+add chain ip nimbus postrouting { type nat hook postrouting priority 100; policy accept; }
+add chain ip nimbus forward { type filter hook forward priority 0; policy accept; }
+flush chain ip nimbus prerouting
+flush chain ip nimbus output
+flush chain ip nimbus postrouting
+flush chain ip nimbus forward
+add rule ip nimbus prerouting dnat ip addr . port to tcp dport map @fwd_tcp
+add rule ip nimbus prerouting dnat ip addr . port to udp dport map @fwd_udp
+add rule ip nimbus output ip daddr 127.0.0.1 dnat ip addr . port to tcp dport map @fwd_tcp
+add rule ip nimbus output ip daddr 127.0.0.1 dnat ip addr . port to udp dport map @fwd_udp
+add rule ip nimbus forward meta l4proto . ip daddr . th dport @backends accept
+add rule ip nimbus postrouting meta l4proto . ip daddr . th dport @backends masquerade
+`
+
+// nftablesForwarder keeps every mapping in a dedicated nimbus table, and
+// applies the changes of one VM in a single nft transaction.
+type nftablesForwarder struct{}
+
+func (f *nftablesForwarder) Name() string {
+	return ForwarderNftables
+}
+
+func (f *nftablesForwarder) Init() error {
+	return runNft(nftablesRuleset)
+}
+
+func (f *nftablesForwarder) Apply(vmIP net.IP, mappings []PortMapping) error {
+	err := checkMappings(vmIP, mappings)
+	if err != nil {
+		return err
+	}
+
+	current, err := f.List()
+	if err != nil {
+		return err
+	}
+
+	// several host ports can point at one guest port, like the forward and
+	// the public port of the direct ingress, but the backend is one element
+	// and deleting it twice fails the whole transaction
+	var script strings.Builder
+	deleted := map[string]bool{}
+	for _, m := range current {
+		if !m.VMIp.Equal(vmIP) {
+			continue
+		}
+		fmt.Fprintf(&script, "delete element ip %s fwd_%s { %d }\n", nftTable, m.Protocol, m.HostPort)
+		backend := nftBackend(m)
+		if !deleted[backend] {
+			deleted[backend] = true
+			fmt.Fprintf(&script, "delete element ip %s backends { %s }\n", nftTable, backend)
+		}
+	}
+	added := map[string]bool{}
+	for _, m := range mappings {
+		fmt.Fprintf(&script, "add element ip %s fwd_%s { %d : %s . %d }\n", nftTable, m.Protocol, m.HostPort, m.VMIp, m.GuestPort)
+		backend := nftBackend(m)
+		if !added[backend] {
+			added[backend] = true
+			fmt.Fprintf(&script, "add element ip %s backends { %s }\n", nftTable, backend)
+		}
+	}
+	if script.Len() == 0 {
+		return nil
+	}
+
+	err = runNft(script.String())
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("applied %d nftables mappings for %s", len(mappings), vmIP)
+	return nil
+}
+
+func (f *nftablesForwarder) List() ([]PortMapping, error) {
+	var mappings []PortMapping
+	for _, protocol := range []Protocol{ProtocolTCP, ProtocolUDP} {
+		elems, err := listNftMap("fwd_" + string(protocol))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range elems {
+			m, err := parseNftElem(protocol, e)
+			if err != nil {
+				return nil, err
+			}
+			mappings = append(mappings, m)
+		}
+	}
+	return mappings, nil
+}
+
+// nftBackend is the element of the backends set of a mapping.
+func nftBackend(m PortMapping) string {
+	return fmt.Sprintf("%s . %s . %d", m.Protocol, m.VMIp, m.GuestPort)
+}
+
+// runNft applies a script with nft -f, which is a single transaction.
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft failed: %v, output: %s", err, output)
+	}
+	return nil
+}
+
+// listNftMap returns the raw [key, value] elements of a map in the nimbus
+// table, as printed by nft -j.
+func listNftMap(name string) ([][2]json.RawMessage, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("nft", "-j", "list", "map", "ip", nftTable, name)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("nft list map %s failed: %v, output: %s", name, err, stderr.String())
+	}
+
+	var listing struct {
+		Nftables []struct {
+			Map *struct {
+				Elem [][2]json.RawMessage `json:"elem"`
+			} `json:"map"`
+		} `json:"nftables"`
+	}
+	err = json.Unmarshal(stdout.Bytes(), &listing)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse nft output: %v", err)
+	}
+
+	for _, obj := range listing.Nftables {
+		if obj.Map != nil {
+			return obj.Map.Elem, nil
+		}
+	}
+	return nil, nil
+}
+
+// parseNftElem reads one element of a fwd_* map, which looks like
+// [10001, {"concat": ["192.168.0.2", 25565]}].
+func parseNftElem(protocol Protocol, elem [2]json.RawMessage) (PortMapping, error) {
+	var hostPort int
+	err := json.Unmarshal(elem[0], &hostPort)
+	if err != nil {
+		return PortMapping{}, fmt.Errorf("unexpected nft map key %s", elem[0])
+	}
+
+	var value struct {
+		Concat [2]json.RawMessage `json:"concat"`
+	}
+	var ip string
+	var guestPort int
+	err = json.Unmarshal(elem[1], &value)
+	if err == nil {
+		err = json.Unmarshal(value.Concat[0], &ip)
+	}
+	if err == nil {
+		err = json.Unmarshal(value.Concat[1], &guestPort)
+	}
+	if err != nil || net.ParseIP(ip) == nil {
+		return PortMapping{}, fmt.Errorf("unexpected nft map value %s", elem[1])
+	}
+
+	return PortMapping{
+		Protocol:  protocol,
+		HostPort:  hostPort,
+		VMIp:      net.ParseIP(ip),
+		GuestPort: guestPort,
+	}, nil
+}
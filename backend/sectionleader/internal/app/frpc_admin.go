@@ -0,0 +1,146 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	frpcStatusRunning = "running"
+
+	// how often WaitReady polls the proxy status
+	frpcPollInterval = time.Millisecond * 250
+)
+
+// frpcProxyStatus is one proxy as reported by GET /api/status.
+type frpcProxyStatus struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Status     string `json:"status"`
+	Err        string `json:"err"`
+	LocalAddr  string `json:"local_addr"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// frpcAdminClient talks to the admin api frpc serves when its webServer is
+// configured.
+type frpcAdminClient struct {
+	baseUrl  string
+	user     string
+	password string
+	client   *http.Client
+}
+
+func newFrpcAdminClient(addr string, user string, password string) *frpcAdminClient {
+	return &frpcAdminClient{
+		baseUrl:  "http://" + addr,
+		user:     user,
+		password: password,
+		client:   &http.Client{Timeout: time.Second * 5},
+	}
+}
+
+func (c *frpcAdminClient) get(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseUrl+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("frpc admin api: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("frpc admin api: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("frpc admin api %s returned %d: %s", path, resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+// reload makes frpc re-read its config, including the per machine files
+func (c *frpcAdminClient) reload(ctx context.Context) error {
+	_, err := c.get(ctx, "/api/reload")
+	return err
+}
+
+// status returns every proxy frpc knows about, by name
+func (c *frpcAdminClient) status(ctx context.Context) (map[string]frpcProxyStatus, error) {
+	body, err := c.get(ctx, "/api/status")
+	if err != nil {
+		return nil, err
+	}
+
+	// proxies are grouped by type
+	var byType map[string][]frpcProxyStatus
+	err = json.Unmarshal(body, &byType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse frpc status: %v", err)
+	}
+
+	proxies := make(map[string]frpcProxyStatus)
+	for _, list := range byType {
+		for _, p := range list {
+			proxies[p.Name] = p
+		}
+	}
+	return proxies, nil
+}
+
+// waitRunning polls the proxy status until every named proxy is running. If
+// ctx is done first, the proxies that are not running are returned in an
+// *IngressNotReadyError, with what the last status that came back said.
+func (c *frpcAdminClient) waitRunning(ctx context.Context, names []string) error {
+	ticker := time.NewTicker(frpcPollInterval)
+	defer ticker.Stop()
+
+	var last map[string]string
+	for {
+		proxies, err := c.status(ctx)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if err != nil && last != nil {
+			// the poll was cut short by ctx
+			return &IngressNotReadyError{Proxies: last}
+		}
+
+		notRunning := make(map[string]string)
+		for _, name := range names {
+			p, ok := proxies[name]
+			switch {
+			case err != nil:
+				notRunning[name] = "status unavailable"
+			case !ok:
+				notRunning[name] = "not loaded"
+			case p.Status != frpcStatusRunning && p.Err != "":
+				notRunning[name] = p.Status + ": " + p.Err
+			case p.Status != frpcStatusRunning:
+				notRunning[name] = p.Status
+			}
+		}
+		if len(notRunning) == 0 {
+			return nil
+		}
+		if err == nil {
+			last = notRunning
+		}
+
+		select {
+		case <-ctx.Done():
+			return &IngressNotReadyError{Proxies: notRunning}
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFrpcAdmin serves the parts of the frpc admin api the client uses.
+type fakeFrpcAdmin struct {
+	mutex   sync.Mutex
+	reloads int
+	status  string
+	code    int
+}
+
+func (f *fakeFrpcAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	user, password, ok := r.BasicAuth()
+	if !ok || user != "admin" || password != "secret" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if f.code != 0 {
+		http.Error(w, "broken", f.code)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/reload":
+		f.reloads++
+	case "/api/status":
+		w.Write([]byte(f.status))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeFrpcAdmin) set(status string, code int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.status = status
+	f.code = code
+}
+
+func newFakeFrpcAdmin(t *testing.T) (*fakeFrpcAdmin, *frpcAdminClient) {
+	fake := &fakeFrpcAdmin{status: "{}"}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	return fake, newFrpcAdminClient(strings.TrimPrefix(srv.URL, "http://"), "admin", "secret")
+}
+
+func TestFrpcAdminReload(t *testing.T) {
+	fake, client := newFakeFrpcAdmin(t)
+
+	err := client.reload(context.Background())
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if fake.reloads != 1 {
+		t.Fatalf("reloads = %d, want 1", fake.reloads)
+	}
+}
+
+func TestFrpcAdminErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		code     int
+		status   string
+		want     string
+	}{
+		{name: "wrong credentials", password: "wrong", want: "returned 401"},
+		{name: "server error", password: "secret", code: http.StatusInternalServerError, want: "returned 500"},
+		{name: "malformed status", password: "secret", status: "not json", want: "failed to parse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, client := newFakeFrpcAdmin(t)
+			client.password = tt.password
+			if tt.status != "" {
+				fake.set(tt.status, tt.code)
+			} else {
+				fake.set("{}", tt.code)
+			}
+
+			_, err := client.status(context.Background())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("status error = %v, want %q", err, tt.want)
+			}
+			if tt.status == "" {
+				err = client.reload(context.Background())
+				if err == nil || !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("reload error = %v, want %q", err, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFrpcAdminUnreachable(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	srv.Close()
+
+	err := newFrpcAdminClient(addr, "", "").reload(context.Background())
+	if err == nil {
+		t.Fatal("reload of a closed server succeeded")
+	}
+}
+
+func TestFrpcAdminStatus(t *testing.T) {
+	fake, client := newFakeFrpcAdmin(t)
+	fake.set(`{
+		"tcp": [{"name": "a.ssh", "type": "tcp", "status": "running"}],
+		"udp": [{"name": "a.game", "type": "udp", "status": "start error", "err": "port taken"}]
+	}`, 0)
+
+	proxies, err := client.status(context.Background())
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if len(proxies) != 2 {
+		t.Fatalf("got %d proxies, want 2", len(proxies))
+	}
+	if proxies["a.ssh"].Status != frpcStatusRunning || proxies["a.game"].Err != "port taken" {
+		t.Fatalf("unexpected proxies %+v", proxies)
+	}
+}
+
+func TestFrpcAdminWaitRunning(t *testing.T) {
+	fake, client := newFakeFrpcAdmin(t)
+	fake.set(`{"tcp": [{"name": "a.ssh", "status": "new"}]}`, 0)
+
+	go func() {
+		time.Sleep(frpcPollInterval)
+		fake.set(`{"tcp": [{"name": "a.ssh", "status": "running"}, {"name": "a.game", "status": "running"}]}`, 0)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	err := client.waitRunning(ctx, []string{"a.ssh", "a.game"})
+	if err != nil {
+		t.Fatalf("waitRunning: %v", err)
+	}
+}
+
+func TestFrpcAdminWaitRunningTimeout(t *testing.T) {
+	fake, client := newFakeFrpcAdmin(t)
+	fake.set(`{"tcp": [{"name": "a.ssh", "status": "start error", "err": "port taken"}]}`, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), frpcPollInterval*2)
+	defer cancel()
+	err := client.waitRunning(ctx, []string{"a.ssh", "a.game"})
+
+	var notReady *IngressNotReadyError
+	if !errors.As(err, &notReady) {
+		t.Fatalf("waitRunning error = %v, want *IngressNotReadyError", err)
+	}
+	want := map[string]string{"a.ssh": "start error: port taken", "a.game": "not loaded"}
+	for name, reason := range want {
+		if notReady.Proxies[name] != reason {
+			t.Errorf("proxy %s: got %q, want %q", name, notReady.Proxies[name], reason)
+		}
+	}
+}
+
+func TestFrpcAdminWaitRunningStatusError(t *testing.T) {
+	fake, client := newFakeFrpcAdmin(t)
+	fake.set("", http.StatusBadGateway)
+
+	err := client.waitRunning(context.Background(), []string{"a.ssh"})
+	if err == nil || !strings.Contains(err.Error(), "returned 502") {
+		t.Fatalf("waitRunning error = %v, want the status error", err)
+	}
+}
@@ -0,0 +1,375 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
+)
+
+const (
+	// the snapshot a hibernated machine is woken from, snapshot names given
+	// by users can not start with a dot
+	hibernationSnapshot = ".hibernation"
+
+	// traffic below this many bytes between two checks, like ARP or the odd
+	// NTP packet, does not count as activity
+	idleNoiseBytes = 4096
+)
+
+var ErrMachineHibernated = errors.New("machine is hibernated, wake it first")
+
+// idleTracker is what the idle detector remembers of an active machine.
+type idleTracker struct {
+	bytes      uint64
+	lastActive time.Time
+}
+
+// HibernateVM snapshots an active machine to disk and stops its VMM. Until it
+// is woken the server listens on its forwarded ports, and the first
+// connection wakes it. Ssh through the frpc or local ingress goes straight to
+// the guest and does not wake the machine, so the idle detector leaves such
+// machines alone; hibernating them by hand means waking them by hand.
+func (manager *VMManager) HibernateVM(id MachineUUID) error {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), constants.SnapshotTimeout)
+	defer cancelFunc()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		return ErrMachineNotFound
+	}
+	err := checkTransition(vmPtr.State, StateHibernated)
+	if err != nil {
+		return err
+	}
+
+	// left behind by a wake that could not remove it
+	err = os.RemoveAll(snapshotDir(id, hibernationSnapshot))
+	if err != nil {
+		return err
+	}
+	_, err = manager.takeSnapshot(ctx, vmPtr, hibernationSnapshot, false)
+	if err != nil {
+		return fmt.Errorf("hibernate machine %s: %v", id.String(), err)
+	}
+
+	err = manager.cleanupAllForwarding(vmPtr)
+	if err != nil {
+		logrus.Errorf("failed to cleanup port forwarding for VM %s: %v", id.String(), err)
+	}
+	err = killVMM(ctx, vmPtr)
+	if err != nil {
+		// the VMM is still there, paused by the snapshot
+		vmPtr.State = StatePaused
+		manager.applyForwarding(vmPtr, vmPtr.data.ExposedPorts)
+		manager.persist(vmPtr)
+		return fmt.Errorf("hibernate machine %s: stop vmm: %v", id.String(), err)
+	}
+
+	if vmPtr.jail != nil {
+		err = os.RemoveAll(filepath.Dir(jailRootPath(vmPtr.jail.cfg.ChrootBaseDir, "firecracker", id)))
+		if err != nil {
+			logrus.Warnf("remove jail of hibernated machine %s: %v", id.String(), err)
+		}
+		manager.releaseJailSlot(vmPtr.jail)
+		vmPtr.jail = nil
+	}
+	vmPtr.Machine = nil
+	vmPtr.cancel = nil
+	vmPtr.data.Pid = 0
+	vmPtr.State = StateHibernated
+	manager.persist(vmPtr)
+
+	manager.startWakeListeners(vmPtr)
+	logrus.Infof("hibernated machine %s", id.String())
+	return nil
+}
+
+// WakeVM makes a machine active again. A hibernated machine is restored from
+// its hibernation snapshot and a paused one is resumed, waking an active
+// machine does nothing.
+func (manager *VMManager) WakeVM(id MachineUUID) (MachineData, error) {
+	data, restored, err := manager.wake(id)
+	if err != nil || !restored {
+		return data, err
+	}
+	return manager.waitIngress(id)
+}
+
+func (manager *VMManager) wake(id MachineUUID) (MachineData, bool, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		return MachineData{}, false, ErrMachineNotFound
+	}
+
+	switch vmPtr.State {
+	case StateActive:
+		return vmPtr.data, false, nil
+	case StatePaused:
+		ctx, cancelFunc := context.WithTimeout(context.Background(), constants.DefaultTimeout)
+		defer cancelFunc()
+		err := vmPtr.Machine.ResumeVM(ctx)
+		if err != nil {
+			return MachineData{}, false, fmt.Errorf("resume machine %s: %v", id.String(), err)
+		}
+		vmPtr.State = StateActive
+		manager.persist(vmPtr)
+		return vmPtr.data, false, nil
+	case StateHibernated:
+		start := time.Now()
+		data, err := manager.restoreLocked(vmPtr, hibernationSnapshot)
+		if err != nil {
+			return MachineData{}, false, fmt.Errorf("wake machine %s: %v", id.String(), err)
+		}
+		logrus.Infof("woke machine %s in %v", id.String(), time.Since(start).Round(time.Millisecond))
+		return data, true, nil
+	}
+	return MachineData{}, false, &InvalidTransitionError{From: vmPtr.State, To: StateActive}
+}
+
+// startWakeListeners listens on every host port forwarded to a hibernated
+// machine, must be called with manager.mutex held.
+func (manager *VMManager) startWakeListeners(vmPtr *VM) {
+	id := vmPtr.Id
+	for _, m := range manager.forwardingMappings(vmPtr, vmPtr.data.ExposedPorts) {
+		addr := ":" + strconv.Itoa(m.HostPort)
+		switch m.Protocol {
+		case ProtocolTCP:
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				logrus.Errorf("listen on port %d to wake machine %s: %v", m.HostPort, id.String(), err)
+				continue
+			}
+			manager.wakers[id] = append(manager.wakers[id], listener)
+			go manager.acceptWake(listener, id, m)
+		case ProtocolUDP:
+			conn, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				logrus.Errorf("listen on udp port %d to wake machine %s: %v", m.HostPort, id.String(), err)
+				continue
+			}
+			manager.wakers[id] = append(manager.wakers[id], conn)
+			go manager.readWake(conn, id)
+		}
+	}
+}
+
+// stopWakeListeners must be called with manager.mutex held.
+func (manager *VMManager) stopWakeListeners(id MachineUUID) {
+	for _, c := range manager.wakers[id] {
+		c.Close()
+	}
+	delete(manager.wakers, id)
+}
+
+// acceptWake wakes the machine on every connection and proxies it to the
+// guest, it returns once the listener is closed by the wake.
+func (manager *VMManager) acceptWake(listener net.Listener, id MachineUUID, m PortMapping) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go manager.wakeAndProxy(conn, id, m)
+	}
+}
+
+func (manager *VMManager) wakeAndProxy(conn net.Conn, id MachineUUID, m PortMapping) {
+	defer conn.Close()
+
+	_, err := manager.WakeVM(id)
+	if err != nil {
+		logrus.Errorf("wake machine %s on connection to port %d: %v", id.String(), m.HostPort, err)
+		return
+	}
+
+	guest, err := net.DialTimeout("tcp", net.JoinHostPort(m.VMIp.String(), strconv.Itoa(m.GuestPort)), constants.DefaultTimeout)
+	if err != nil {
+		logrus.Errorf("connect to port %d of woken machine %s: %v", m.GuestPort, id.String(), err)
+		return
+	}
+	defer guest.Close()
+
+	// later connections are forwarded to the guest directly, only this one
+	// goes through the server
+	proxyConns(conn, guest)
+}
+
+// proxyConns copies between a and b until both directions are done. A side
+// that finishes sending has its half of the other connection closed, so a
+// client that half-closes after its request still gets the whole reply.
+func proxyConns(a net.Conn, b net.Conn) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst net.Conn, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	wg.Add(2)
+	go copyHalf(b, a)
+	go copyHalf(a, b)
+	wg.Wait()
+}
+
+// readWake wakes the machine on the first datagram, which is dropped.
+func (manager *VMManager) readWake(conn net.PacketConn, id MachineUUID) {
+	buf := make([]byte, 1)
+	_, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		return
+	}
+
+	_, err = manager.WakeVM(id)
+	if err != nil {
+		logrus.Errorf("wake machine %s on datagram: %v", id.String(), err)
+	}
+}
+
+// StartIdleDetector hibernates active machines whose network traffic stayed
+// under idleNoiseBytes per check for the idle timeout. It does nothing if the
+// timeout is zero.
+func (manager *VMManager) StartIdleDetector() {
+	if manager.cfg.Idle.Timeout == 0 {
+		return
+	}
+	logrus.Infof("hibernating machines idle for %v, checking every %v", manager.cfg.Idle.Timeout, manager.cfg.Idle.CheckInterval)
+	// any machine with an ssh port tells whether the ingress can wake them
+	if !manager.sshWakes(MachineData{RemotePort: 1}) {
+		logrus.Warnf("ssh through the %s ingress cannot wake machines, machines with an ssh port are never hibernated when idle", manager.ingress.Name())
+	}
+
+	go func() {
+		trackers := make(map[MachineUUID]*idleTracker)
+		ticker := time.NewTicker(manager.cfg.Idle.CheckInterval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			for _, id := range manager.idleMachines(trackers, now) {
+				logrus.Infof("machine %s has been idle for %v", id.String(), manager.cfg.Idle.Timeout)
+				err := manager.HibernateVM(id)
+				if err != nil {
+					logrus.Errorf("hibernate idle machine %s: %v", id.String(), err)
+				}
+			}
+		}
+	}()
+}
+
+// idleMachines updates trackers with the traffic counters of every active
+// machine, and returns the machines that have been idle for the timeout.
+func (manager *VMManager) idleMachines(trackers map[MachineUUID]*idleTracker, now time.Time) []MachineUUID {
+	active := make(map[MachineUUID]net.IP)
+	manager.mutex.Lock()
+	for id, vmPtr := range manager.VMs {
+		if vmPtr.State == StateActive && vmPtr.Machine != nil && manager.sshWakes(vmPtr.data) {
+			active[id] = vmPtr.data.LocalIp.IP
+		}
+	}
+	manager.mutex.Unlock()
+
+	// machines that left the active state start over when they come back
+	for id := range trackers {
+		if _, ok := active[id]; !ok {
+			delete(trackers, id)
+		}
+	}
+
+	var idle []MachineUUID
+	for id, ip := range active {
+		bytes, err := hostVethBytes(ip)
+		if err != nil {
+			logrus.Warnf("traffic counters of machine %s: %v", id.String(), err)
+			continue
+		}
+
+		tracker, ok := trackers[id]
+		if !ok {
+			trackers[id] = &idleTracker{bytes: bytes, lastActive: now}
+			continue
+		}
+		// the counters start over when a restore recreates the veth
+		if bytes < tracker.bytes || bytes-tracker.bytes > idleNoiseBytes {
+			tracker.lastActive = now
+		}
+		tracker.bytes = bytes
+
+		if now.Sub(tracker.lastActive) >= manager.cfg.Idle.Timeout {
+			idle = append(idle, id)
+		}
+	}
+	return idle
+}
+
+// sshWakes reports whether a connection to the ssh port of the machine would
+// wake it once hibernated, that is whether the port is forwarded by the host
+// where a wake listener can take its place.
+func (manager *VMManager) sshWakes(data MachineData) bool {
+	if data.RemotePort == 0 {
+		return true
+	}
+	return slices.ContainsFunc(manager.ingress.Mappings(data), func(m PortMapping) bool {
+		return m.Protocol == ProtocolTCP && m.HostPort == data.RemotePort
+	})
+}
+
+// hostVethBytes returns the bytes received and sent by the host end of the
+// veth of the VM at vmIp, which holds the gateway address of its /30.
+func hostVethBytes(vmIp net.IP) (uint64, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0, err
+	}
+
+	subnet := vmIp.Mask(net.CIDRMask(30, 32))
+	for _, iface := range ifaces {
+		if !strings.HasPrefix(iface.Name, "veth") {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil || !ipNet.IP.Mask(net.CIDRMask(30, 32)).Equal(subnet) {
+				continue
+			}
+
+			var total uint64
+			for _, counter := range []string{"rx_bytes", "tx_bytes"} {
+				value, err := os.ReadFile(filepath.Join("/sys/class/net", iface.Name, "statistics", counter))
+				if err != nil {
+					return 0, err
+				}
+				n, err := strconv.ParseUint(strings.TrimSpace(string(value)), 10, 64)
+				if err != nil {
+					return 0, fmt.Errorf("%s of %s: %v", counter, iface.Name, err)
+				}
+				total += n
+			}
+			return total, nil
+		}
+	}
+	return 0, fmt.Errorf("no host veth in the /30 of %s", vmIp)
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestProxyConnsHalfClose checks that a client that half-closes after its
+// request still gets the reply the guest sends after reading it to the end.
+func TestProxyConnsHalfClose(t *testing.T) {
+	guestListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guestListener.Close()
+	go func() {
+		conn, err := guestListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		// reply only once the client is done, and a little later
+		time.Sleep(50 * time.Millisecond)
+		conn.Write(append([]byte("reply to "), request...))
+	}()
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyListener.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := proxyListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		guest, err := net.Dial("tcp", guestListener.Addr().String())
+		if err != nil {
+			t.Errorf("dial guest: %v", err)
+			return
+		}
+		defer guest.Close()
+		proxyConns(conn, guest)
+	}()
+
+	client, err := net.Dial("tcp", proxyListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = client.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.(*net.TCPConn).CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("read reply: %v", err)
+	}
+	if string(reply) != "reply to hello" {
+		t.Fatalf("reply = %q, want %q", reply, "reply to hello")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy did not return after both sides finished")
+	}
+}
@@ -0,0 +1,181 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/config"
+)
+
+const (
+	IngressFrpc   = "frpc"
+	IngressDirect = "direct"
+	IngressLocal  = "local"
+)
+
+// IngressProvider makes the ssh port and the exposed ports of a machine
+// reachable from outside the host, at the public ports allocated for them.
+type IngressProvider interface {
+	Name() string
+
+	// PublicAddress is the host clients connect to
+	PublicAddress() string
+
+	// Mappings returns the host forwarding the provider needs on top of the
+	// exposed host ports, they are applied together by the Forwarder.
+	Mappings(data MachineData) []PortMapping
+
+	// Publish replaces whatever was published for the machine
+	Publish(data MachineData) error
+
+	// WaitReady waits until what was published for the machine is reachable.
+	// It returns an *IngressNotReadyError if parts of it are still not up
+	// when ctx is done.
+	WaitReady(ctx context.Context, data MachineData) error
+
+	// Unpublish removes everything published for the machine, it succeeds if
+	// nothing was published.
+	Unpublish(id MachineUUID) error
+
+	// Reconcile removes state left by machines for which running is false.
+	Reconcile(running func(MachineUUID) bool, report *ReconcileReport)
+}
+
+// IngressNotReadyError lists the proxies of a machine that are not running,
+// with their last status.
+type IngressNotReadyError struct {
+	Proxies map[string]string
+}
+
+func (e *IngressNotReadyError) Error() string {
+	names := make([]string, 0, len(e.Proxies))
+	for name := range e.Proxies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s (%s)", name, e.Proxies[name]))
+	}
+	return "proxies not running: " + strings.Join(parts, ", ")
+}
+
+func NewIngressProvider(cfg config.IngressConfig) (IngressProvider, error) {
+	switch cfg.Provider {
+	case IngressFrpc:
+		return &frpcIngress{
+			publicAddress: cfg.PublicAddress,
+			configDir:     cfg.FrpcConfigDir,
+			admin:         newFrpcAdminClient(cfg.FrpcAdminAddr, cfg.FrpcAdminUser, cfg.FrpcAdminPassword),
+		}, nil
+	case IngressDirect:
+		return &directIngress{publicAddress: cfg.PublicAddress}, nil
+	case IngressLocal:
+		return &localIngress{publicAddress: cfg.PublicAddress}, nil
+	}
+	return nil, fmt.Errorf("unknown ingress provider %q", cfg.Provider)
+}
+
+// PublicAddress is the address returned to clients for every public port.
+func (manager *VMManager) PublicAddress() string {
+	return manager.ingress.PublicAddress()
+}
+
+// publish must be called with manager.mutex held.
+func (manager *VMManager) publish(vmPtr *VM) error {
+	err := manager.ingress.Publish(vmPtr.data)
+	if err != nil {
+		return fmt.Errorf("%s ingress for %s: %v", manager.ingress.Name(), vmPtr.Id.String(), err)
+	}
+	logrus.Infof("published machine %s through %s ingress", vmPtr.Id.String(), manager.ingress.Name())
+	return nil
+}
+
+// directIngress publishes ports on the host itself, the public ports are
+// forwarded straight to the VM.
+type directIngress struct {
+	publicAddress string
+}
+
+func (i *directIngress) Name() string {
+	return IngressDirect
+}
+
+func (i *directIngress) PublicAddress() string {
+	return i.publicAddress
+}
+
+func (i *directIngress) Mappings(data MachineData) []PortMapping {
+	var mappings []PortMapping
+	if data.RemotePort != 0 {
+		mappings = append(mappings, PortMapping{
+			Protocol:  ProtocolTCP,
+			HostPort:  data.RemotePort,
+			VMIp:      data.LocalIp.IP,
+			GuestPort: 22,
+		})
+	}
+	for _, p := range data.ExposedPorts {
+		mappings = append(mappings, PortMapping{
+			Protocol:  p.Protocol,
+			HostPort:  p.PublicPort,
+			VMIp:      data.LocalIp.IP,
+			GuestPort: p.GuestPort,
+		})
+	}
+	return mappings
+}
+
+// the forwarding rules are all there is to publish
+func (i *directIngress) Publish(data MachineData) error {
+	return nil
+}
+
+func (i *directIngress) WaitReady(ctx context.Context, data MachineData) error {
+	return nil
+}
+
+func (i *directIngress) Unpublish(id MachineUUID) error {
+	return nil
+}
+
+func (i *directIngress) Reconcile(running func(MachineUUID) bool, report *ReconcileReport) {
+}
+
+// localIngress publishes nothing, for development on a single host. The
+// exposed ports are reachable on the host at their host port, and ssh at the
+// VM ip.
+type localIngress struct {
+	publicAddress string
+}
+
+func (i *localIngress) Name() string {
+	return IngressLocal
+}
+
+func (i *localIngress) PublicAddress() string {
+	return i.publicAddress
+}
+
+func (i *localIngress) Mappings(data MachineData) []PortMapping {
+	return nil
+}
+
+func (i *localIngress) Publish(data MachineData) error {
+	return nil
+}
+
+func (i *localIngress) WaitReady(ctx context.Context, data MachineData) error {
+	return nil
+}
+
+func (i *localIngress) Unpublish(id MachineUUID) error {
+	return nil
+}
+
+func (i *localIngress) Reconcile(running func(MachineUUID) bool, report *ReconcileReport) {
+}
@@ -0,0 +1,178 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
+)
+
+type proxyConfig struct {
+	Name       string `toml:"name"`
+	ConnType   string `toml:"type"`
+	LocalIp    net.IP `toml:"localIP"`
+	LocalPort  int    `toml:"localPort"`
+	RemotePort int    `toml:"remotePort"`
+}
+
+type frpcConfig struct {
+	Proxies []proxyConfig `toml:"proxies"`
+}
+
+// frpcIngress writes one frpc proxy config per machine into configDir, which
+// the frpc config includes, and reloads frpc through its admin api after
+// every change.
+type frpcIngress struct {
+	publicAddress string
+	configDir     string
+	admin         *frpcAdminClient
+}
+
+func (i *frpcIngress) Name() string {
+	return IngressFrpc
+}
+
+func (i *frpcIngress) PublicAddress() string {
+	return i.publicAddress
+}
+
+// frpc connects to the ssh port directly and to the exposed host ports, so
+// nothing beyond the exposed ports is forwarded
+func (i *frpcIngress) Mappings(data MachineData) []PortMapping {
+	return nil
+}
+
+func (i *frpcIngress) Publish(data MachineData) error {
+	if data.RemotePort < constants.MinRemotePort || data.RemotePort > constants.MaxRemotePort {
+		return fmt.Errorf("SSH port requested outside allowed port range")
+	}
+
+	// SSH proxy configuration (existing)
+	sshCfg := proxyConfig{
+		Name:       sshProxyName(data.Id),
+		ConnType:   "tcp",
+		LocalIp:    data.LocalIp.IP,
+		LocalPort:  22,
+		RemotePort: data.RemotePort,
+	}
+	proxiesConfig := frpcConfig{
+		Proxies: []proxyConfig{sshCfg},
+	}
+
+	// one proxy per exposed guest port
+	for _, p := range data.ExposedPorts {
+		if p.PublicPort < constants.MinGameRemotePort || p.PublicPort > constants.MaxGameRemotePort {
+			return fmt.Errorf("public port %d for guest port %d outside allowed port range", p.PublicPort, p.GuestPort)
+		}
+
+		proxiesConfig.Proxies = append(proxiesConfig.Proxies, proxyConfig{
+			Name:       proxyName(data.Id, p),
+			ConnType:   string(p.Protocol),
+			LocalIp:    net.IPv4(127, 0, 0, 1), // localhost since the host port is forwarded to the VM
+			LocalPort:  p.HostPort,
+			RemotePort: p.PublicPort,
+		})
+	}
+
+	err := os.MkdirAll(i.configDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(i.configPath(data.Id))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = toml.NewEncoder(file).Encode(proxiesConfig)
+	if err != nil {
+		return err
+	}
+
+	return i.reload()
+}
+
+// WaitReady waits until frpc reports every proxy of the machine as running.
+func (i *frpcIngress) WaitReady(ctx context.Context, data MachineData) error {
+	names := []string{sshProxyName(data.Id)}
+	for _, p := range data.ExposedPorts {
+		names = append(names, proxyName(data.Id, p))
+	}
+	return i.admin.waitRunning(ctx, names)
+}
+
+// Unpublish drops the proxies of a machine and reloads frpc
+func (i *frpcIngress) Unpublish(id MachineUUID) error {
+	err := os.Remove(i.configPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return i.reload()
+}
+
+// Reconcile drops proxies for machines that are not running, so frps does not
+// hand out ports that lead nowhere.
+func (i *frpcIngress) Reconcile(running func(MachineUUID) bool, report *ReconcileReport) {
+	paths, err := filepath.Glob(i.configDir + "/*.toml")
+	if err != nil {
+		report.add("frpc config", i.configDir, ActionFailed, err)
+		return
+	}
+
+	removed := false
+	for _, path := range paths {
+		id, ok := parseMachineId(strings.TrimSuffix(filepath.Base(path), ".toml"))
+		if ok && running(id) {
+			report.add("frpc config", path, ActionKept, nil)
+			continue
+		}
+		err := os.Remove(path)
+		report.add("frpc config", path, ActionRemoved, err)
+		removed = removed || err == nil
+	}
+
+	if removed {
+		err := i.reload()
+		if err != nil {
+			report.add("frpc config", "reload", ActionFailed, err)
+		}
+	}
+}
+
+func (i *frpcIngress) configPath(id MachineUUID) string {
+	return i.configDir + "/" + id.String() + ".toml"
+}
+
+// reload makes frpc pick up added or removed proxy configs
+func (i *frpcIngress) reload() error {
+	err := i.admin.reload(context.Background())
+	if err != nil {
+		return fmt.Errorf("reload frpc error, err: %v", err)
+	}
+	return nil
+}
+
+func sshProxyName(id MachineUUID) string {
+	return id.String() + "-ssh"
+}
+
+// proxyName keeps the original -game name for the default game port
+func proxyName(id MachineUUID, p ExposedPort) string {
+	if p.GuestPort == constants.InternalGamePort && p.Protocol == ProtocolTCP {
+		return id.String() + "-game"
+	}
+	if p.Protocol == ProtocolUDP {
+		return fmt.Sprintf("%s-port-%d-udp", id.String(), p.GuestPort)
+	}
+	return fmt.Sprintf("%s-port-%d", id.String(), p.GuestPort)
+}
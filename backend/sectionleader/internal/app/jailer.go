@@ -0,0 +1,235 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/config"
+)
+
+const (
+	jailSocketPath = "/run/firecracker.socket"
+	netNSDir       = "/var/run/netns"
+
+	linkJailFilesHandlerName = "nimbus.LinkJailFiles"
+
+	// extra memory allowed in the VM cgroup on top of guest memory, for the
+	// VMM itself
+	jailMemOverheadMib = 64
+	cpuPeriodUs        = 100000
+)
+
+// jailSpec is the jailer placement of a single VM.
+type jailSpec struct {
+	slot int
+	uid  int
+	gid  int
+	cfg  config.JailerConfig
+}
+
+// jailRootPath is the host path of the chroot the jailer builds for a VM.
+func jailRootPath(chrootBaseDir string, execFile string, id MachineUUID) string {
+	return filepath.Join(chrootBaseDir, filepath.Base(execFile), id.String(), "root")
+}
+
+// allocJailSlot reserves a uid/gid slot for a new jailed VM. Returns nil if the
+// jailer is disabled.
+func (manager *VMManager) allocJailSlot() (*jailSpec, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	return manager.takeJailSlot()
+}
+
+// takeJailSlot is allocJailSlot, must be called with manager.mutex held.
+func (manager *VMManager) takeJailSlot() (*jailSpec, error) {
+	if !manager.cfg.Jailer.Enabled {
+		return nil, nil
+	}
+
+	for slot := 0; slot < manager.cfg.Jailer.MaxJails; slot++ {
+		if manager.jailSlots[slot] {
+			continue
+		}
+		manager.jailSlots[slot] = true
+		return &jailSpec{
+			slot: slot,
+			uid:  manager.cfg.Jailer.UidBase + slot,
+			gid:  manager.cfg.Jailer.GidBase + slot,
+			cfg:  manager.cfg.Jailer,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no free jail slots, all %d in use", manager.cfg.Jailer.MaxJails)
+}
+
+// releaseJailSlot must be called with manager.mutex held.
+func (manager *VMManager) releaseJailSlot(jail *jailSpec) {
+	if jail == nil {
+		return
+	}
+	delete(manager.jailSlots, jail.slot)
+}
+
+// buildJailerCommand builds the jailer invocation for a VM. The SDK's own
+// builder can only place the VM in a cpuset cgroup, so the command is built
+// here to also set a parent cgroup and cpu/memory limits.
+func buildJailerCommand(ctx context.Context, opts *options, netNS string, stdout io.Writer, stderr io.Writer) (*exec.Cmd, error) {
+	execFile, err := filepath.Abs(opts.ExecFile)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"--id", opts.Id,
+		"--uid", strconv.Itoa(opts.Uid),
+		"--gid", strconv.Itoa(opts.Gid),
+		"--exec-file", execFile,
+		"--chroot-base-dir", opts.ChrootBaseDir,
+		"--netns", netNS,
+		"--cgroup-version", opts.CgroupVersion,
+	}
+
+	if opts.ParentCgroup != "" {
+		args = append(args, "--parent-cgroup", opts.ParentCgroup)
+	}
+
+	memMax := (opts.FcMemSz + jailMemOverheadMib) * 1024 * 1024
+	if opts.CgroupVersion == "2" {
+		args = append(args,
+			"--cgroup", fmt.Sprintf("memory.max=%d", memMax),
+			"--cgroup", fmt.Sprintf("cpu.max=%d %d", opts.FcCPUCount*cpuPeriodUs, cpuPeriodUs),
+		)
+	} else {
+		args = append(args,
+			"--cgroup", fmt.Sprintf("memory.limit_in_bytes=%d", memMax),
+			"--cgroup", fmt.Sprintf("cpu.cfs_quota_us=%d", opts.FcCPUCount*cpuPeriodUs),
+			"--cgroup", fmt.Sprintf("cpu.cfs_period_us=%d", cpuPeriodUs),
+		)
+	}
+
+	if cpulist, err := os.ReadFile(fmt.Sprintf("/sys/devices/system/node/node%d/cpulist", opts.NumaNode)); err == nil {
+		args = append(args,
+			"--cgroup", fmt.Sprintf("cpuset.mems=%d", opts.NumaNode),
+			"--cgroup", fmt.Sprintf("cpuset.cpus=%s", strings.TrimSpace(string(cpulist))),
+		)
+	}
+
+	args = append(args, "--", "--api-sock", jailSocketPath)
+
+	cmd := exec.CommandContext(ctx, opts.JailerBinary, args...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd, nil
+}
+
+// jailChrootStrategy moves the kernel and drives into the jail. It hard links
+// where possible and falls back to copying when the chroot is on a different
+// filesystem, then hands the files to the VM's uid so firecracker can open
+// them after dropping privileges.
+type jailChrootStrategy struct {
+	uid int
+	gid int
+}
+
+func newJailChrootStrategy(uid int, gid int) jailChrootStrategy {
+	return jailChrootStrategy{uid: uid, gid: gid}
+}
+
+func (s jailChrootStrategy) AdaptHandlers(handlers *firecracker.Handlers) error {
+	if !handlers.FcInit.Has(firecracker.CreateLogFilesHandlerName) {
+		return firecracker.ErrRequiredHandlerMissing
+	}
+
+	handlers.FcInit = handlers.FcInit.AppendAfter(
+		firecracker.CreateLogFilesHandlerName,
+		firecracker.Handler{
+			Name: linkJailFilesHandlerName,
+			Fn:   s.linkFiles,
+		},
+	)
+	return nil
+}
+
+func (s jailChrootStrategy) linkFiles(ctx context.Context, m *firecracker.Machine) error {
+	if m.Cfg.JailerCfg == nil {
+		return firecracker.ErrMissingJailerConfig
+	}
+
+	rootfs := filepath.Join(
+		m.Cfg.JailerCfg.ChrootBaseDir,
+		filepath.Base(m.Cfg.JailerCfg.ExecFile),
+		m.Cfg.JailerCfg.ID,
+		"root",
+	)
+
+	kernelName := filepath.Base(m.Cfg.KernelImagePath)
+	err := s.placeFile(m.Cfg.KernelImagePath, filepath.Join(rootfs, kernelName))
+	if err != nil {
+		return fmt.Errorf("place kernel in jail: %v", err)
+	}
+	m.Cfg.KernelImagePath = kernelName
+
+	for i, drive := range m.Cfg.Drives {
+		hostPath := firecracker.StringValue(drive.PathOnHost)
+		driveName := filepath.Base(hostPath)
+
+		err = s.placeFile(hostPath, filepath.Join(rootfs, driveName))
+		if err != nil {
+			return fmt.Errorf("place drive %s in jail: %v", driveName, err)
+		}
+		m.Cfg.Drives[i].PathOnHost = firecracker.String(driveName)
+	}
+
+	// a restored VM loads its snapshot from inside the jail as well
+	if m.Cfg.Snapshot.SnapshotPath != "" {
+		for _, p := range []*string{&m.Cfg.Snapshot.MemFilePath, &m.Cfg.Snapshot.SnapshotPath} {
+			name := filepath.Base(*p)
+			err = s.placeFile(*p, filepath.Join(rootfs, name))
+			if err != nil {
+				return fmt.Errorf("place snapshot file %s in jail: %v", name, err)
+			}
+			*p = name
+		}
+	}
+
+	return nil
+}
+
+func (s jailChrootStrategy) placeFile(src string, dst string) error {
+	err := os.Link(src, dst)
+	if errors.Is(err, syscall.EXDEV) {
+		err = copyFile(src, dst)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Chown(dst, s.uid, s.gid)
+}
+
+func copyFile(src string, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	_, err = io.Copy(dstFile, srcFile)
+	return err
+}
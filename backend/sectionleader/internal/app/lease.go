@@ -0,0 +1,139 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/config"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
+)
+
+var (
+	ErrInvalidLease = errors.New("invalid lease")
+	ErrLeaseExpired = errors.New("machine lease has expired")
+)
+
+// ResolveLease returns the lease of a machine of the given shape, the
+// requested number of seconds or the default if zero. A zero lease never
+// expires. Errors wrap ErrInvalidLease.
+func ResolveLease(shape MachineShape, seconds int64, limits config.LeaseConfig) (time.Duration, error) {
+	limit := limits.Max
+	if classLimit, ok := limits.MaxByClass[shape.Class]; ok && shape.Class != "" {
+		limit = classLimit
+	}
+
+	if seconds == 0 {
+		if limit != 0 && (limits.Default == 0 || limits.Default > limit) {
+			return limit, nil
+		}
+		return limits.Default, nil
+	}
+
+	if seconds < 0 {
+		return 0, fmt.Errorf("%w: lease_seconds must not be negative", ErrInvalidLease)
+	}
+	if seconds > math.MaxInt64/int64(time.Second) {
+		return 0, fmt.Errorf("%w: lease_seconds is too large", ErrInvalidLease)
+	}
+	lease := time.Duration(seconds) * time.Second
+	if limit != 0 && lease > limit {
+		return 0, fmt.Errorf("%w: at most %v for this machine", ErrInvalidLease, limit)
+	}
+	return lease, nil
+}
+
+// ResolveLease checks a requested lease against the configured limits.
+func (manager *VMManager) ResolveLease(shape MachineShape, seconds int64) (time.Duration, error) {
+	return ResolveLease(shape, seconds, manager.cfg.Lease)
+}
+
+// leaseExpiry is when a lease taken now runs out, zero if it never does.
+func leaseExpiry(lease time.Duration) time.Time {
+	if lease == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(lease)
+}
+
+// RenewLease restarts the lease of a machine, with the requested number of
+// seconds or the default, within the quota of its owner. A machine whose lease
+// ran out can not be renewed.
+func (manager *VMManager) RenewLease(id MachineUUID, seconds int64) (MachineData, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		return MachineData{}, ErrMachineNotFound
+	}
+	if expired(vmPtr, time.Now()) {
+		return MachineData{}, ErrLeaseExpired
+	}
+
+	lease, err := manager.ResolveLease(vmPtr.data.Shape, seconds)
+	if err != nil {
+		return MachineData{}, err
+	}
+	if !vmPtr.data.Owner.IsZero() {
+		err = checkLeaseQuota(manager.Quota(vmPtr.data.Owner), lease)
+		if err != nil {
+			return MachineData{}, err
+		}
+	}
+	vmPtr.data.ExpiresAt = leaseExpiry(lease)
+	manager.persist(vmPtr)
+
+	logrus.Infof("renewed lease of machine %s until %v", id.String(), vmPtr.data.ExpiresAt)
+	return vmPtr.data, nil
+}
+
+func expired(vmPtr *VM, now time.Time) bool {
+	return !vmPtr.data.ExpiresAt.IsZero() && !now.Before(vmPtr.data.ExpiresAt)
+}
+
+// StartReaper deletes machines whose lease ran out, checking every reap
+// interval.
+func (manager *VMManager) StartReaper() {
+	go func() {
+		ticker := time.NewTicker(manager.cfg.Lease.ReapInterval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			manager.mutex.Lock()
+			var ids []MachineUUID
+			for id, vmPtr := range manager.VMs {
+				if expired(vmPtr, now) {
+					ids = append(ids, id)
+				}
+			}
+			manager.mutex.Unlock()
+
+			for _, id := range ids {
+				manager.reapVM(id)
+			}
+		}
+	}()
+}
+
+// reapVM shuts a machine down and deletes it, unless its lease was renewed
+// since it was found expired.
+func (manager *VMManager) reapVM(id MachineUUID) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), constants.DefaultTimeout*5)
+	defer cancelFunc()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok := manager.VMs[id]
+	if !ok || !expired(vmPtr, time.Now()) {
+		return
+	}
+	logrus.Infof("lease of machine %s expired at %v, deleting it", id.String(), vmPtr.data.ExpiresAt)
+
+	result := manager.teardownVM(ctx, vmPtr)
+	logrus.Infof("reaped machine %s, all steps ok: %t", id.String(), result.Ok())
+}
@@ -3,7 +3,6 @@ package app
 import (
 	"context"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"path/filepath"
@@ -12,23 +11,36 @@ import (
 
 	"os/exec"
 
-	"github.com/google/uuid"
 	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/images"
 
 	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
 	"github.com/sirupsen/logrus"
 )
 
 const (
-	refSquashFsPath = "./_ref/squashfs"
-	refImgPath      = "./_ref/vmlinux"
-
 	// executableMask is the mask needed to check whether or not a file's
 	// permissions are executable.
 	executableMask         = 0111
 	firecrackerDefaultPath = "firecracker"
+	// vmlinux and squashfs from before the image catalog, used as the default
+	// image when IMAGES_DIR has none
+	legacyRefDir = "./_ref"
 )
 
+// vmSpec is everything SpawnNewVM needs to know about a new VM.
+type vmSpec struct {
+	id     MachineUUID
+	subnet *net.IPNet
+	jail   *jailSpec
+	shape  MachineShape
+	image  images.Image
+	rootfs *rootfsProvisioner
+	// authorizedKeys are public keys given on create, without them a key
+	// pair is generated and the private key kept in the data dir
+	authorizedKeys []string
+}
+
 type vmFilePaths struct {
 	id            MachineUUID
 	kernelImgPath string
@@ -37,27 +49,64 @@ type vmFilePaths struct {
 	stderrPath    string
 }
 
-func SpawnNewVM(ctx context.Context) (*firecracker.Machine, MachineUUID, net.IPNet, error) {
-	id := MachineUUID(uuid.New())
+func SpawnNewVM(ctx context.Context, spec vmSpec) (_ *firecracker.Machine, _ net.IPNet, err error) {
+	id, jail := spec.id, spec.jail
+	defer func() {
+		if err != nil {
+			removeSpawnFiles(spec)
+		}
+	}()
 
-	vmPaths, err := createVMFolder(id)
+	vmPaths, err := createVMFolder(id, spec)
 	if err != nil {
-		logrus.Fatal(err)
-		return nil, id, net.IPNet{}, err
+		return nil, net.IPNet{}, err
 	}
 
-	opts, err := setVMOpts(vmPaths)
+	opts, err := setVMOpts(vmPaths, spec)
 	if err != nil {
-		logrus.Fatal(err)
-		return nil, id, net.IPNet{}, err
+		return nil, net.IPNet{}, err
 	}
 	defer opts.Close()
 
 	machine, err := setupFirecrackerMachine(ctx, opts)
 	if err != nil {
-		return nil, id, net.IPNet{},err
+		return nil, net.IPNet{}, err
+	}
+	if jail != nil {
+		logrus.Infof("vm %s jailed as uid %d, socket %s", id.String(), jail.uid, machine.Cfg.SocketPath)
+	}
+
+	ip, err := startMachine(ctx, machine)
+	if err != nil {
+		return nil, net.IPNet{}, err
+	}
+	return machine, ip, nil
+}
+
+// removeSpawnFiles removes what a failed SpawnNewVM left behind, so the data
+// dir and network config of a machine that never came up do not pile up
+// until the next reconcile.
+func removeSpawnFiles(spec vmSpec) {
+	id := spec.id.String()
+	paths := []string{
+		filepath.Join(constants.DataDirPath, id),
+		CniConfRootDir + "/fcnet-" + id + ".conflist",
+		filepath.Join(cniIpamDir, "fcnet-"+id),
 	}
+	if spec.jail != nil {
+		paths = append(paths, filepath.Dir(jailRootPath(spec.jail.cfg.ChrootBaseDir, "firecracker", spec.id)))
+	}
+	for _, path := range paths {
+		err := os.RemoveAll(path)
+		if err != nil {
+			logrus.Errorf("cleanup of failed vm %s: %v", id, err)
+		}
+	}
+}
 
+// startMachine starts the VMM in the background and waits for it to come up,
+// returning the IP of the guest.
+func startMachine(ctx context.Context, machine *firecracker.Machine) (net.IPNet, error) {
 	machineStartedChannel := make(chan bool)
 	go runFirecrackerMachine(ctx, machine, machineStartedChannel)
 
@@ -65,75 +114,97 @@ func SpawnNewVM(ctx context.Context) (*firecracker.Machine, MachineUUID, net.IPN
 	case machineStarted := <-machineStartedChannel:
 		if machineStarted {
 			// success route
-			ip := machine.Cfg.NetworkInterfaces[0].StaticConfiguration.IPConfiguration.IPAddr
-			return machine, id, ip, nil
+			return machine.Cfg.NetworkInterfaces[0].StaticConfiguration.IPConfiguration.IPAddr, nil
 		} else {
-			return nil, id, net.IPNet{}, fmt.Errorf("machine start fail")
+			return net.IPNet{}, fmt.Errorf("machine start fail")
 		}
 
 	case <-time.After(constants.DefaultTimeout):
-		return nil, id, net.IPNet{}, fmt.Errorf("machine start timed out")
+		return net.IPNet{}, fmt.Errorf("machine start timed out")
 	}
 }
 
-func createVMFolder(id MachineUUID) (vmFilePaths, error) {
+// createVMFolder prepares the data dir of a new VM: its kernel, log files,
+// ssh key and root disk. Errors are a *PrepError naming the failed step.
+func createVMFolder(id MachineUUID, spec vmSpec) (vmFilePaths, error) {
+	img := spec.image
 	dstRootPath := constants.DataDirPath + "/" + id.String()
 	err := os.MkdirAll(dstRootPath, 0755)
 	if err != nil {
-		logrus.Fatal(err)
-		return vmFilePaths{}, err
-	}
-	srcImg, err := os.Open(refImgPath)
-	if err != nil {
-		return vmFilePaths{}, err
-	}
-	defer srcImg.Close()
-	dstImgPath := dstRootPath + "/vmlinux"
-	dstImg, err := os.Create(dstImgPath)
-	if err != nil {
-		return vmFilePaths{}, err
-	}
-	defer dstImg.Close()
-	_, err = io.Copy(dstImg, srcImg)
-	if err != nil {
-		return vmFilePaths{}, err
+		return vmFilePaths{}, prepStep("create data dir", err)
 	}
 
-	extractedFsPath := dstRootPath + "/squashfs-root"
-	err = exec.Command("unsquashfs", "-d", extractedFsPath, refSquashFsPath).Run()
+	dstImgPath := dstRootPath + "/vmlinux"
+	err = copyFile(img.Kernel, dstImgPath)
 	if err != nil {
-		logrus.Fatal(err)
-		return vmFilePaths{}, err
+		return vmFilePaths{}, prepStep("copy kernel", err)
 	}
 
 	stdoutPath := dstRootPath + "/log/stdout.log"
-	os.MkdirAll(filepath.Dir(stdoutPath), 0555)
-	os.Create(stdoutPath)
-
 	stderrPath := dstRootPath + "/log/stderr.log"
-	os.MkdirAll(filepath.Dir(stderrPath), 0555)
-	os.Create(stderrPath)
-
-	err = exec.Command("./prepVM.sh", dstRootPath).Run()
+	err = createLogFiles(stdoutPath, stderrPath)
 	if err != nil {
-		logrus.Fatal(err)
-		return vmFilePaths{}, err
+		return vmFilePaths{}, prepStep("create log files", err)
+	}
+
+	var authorizedKeys []byte
+	if len(spec.authorizedKeys) != 0 {
+		authorizedKeys = authorizedKeysContent(spec.authorizedKeys)
+	} else {
+		authorizedKeys, err = generateSSHKey(dstRootPath, "nimbus-"+id.String())
+		if err != nil {
+			return vmFilePaths{}, prepStep("generate ssh key", err)
+		}
 	}
 
 	fsExt4Path := dstRootPath + "/fs.ext4"
+	err = spec.rootfs.provision(img, fsExt4Path, spec.shape.DiskMib, img.DefaultUser, authorizedKeys)
+	if err != nil {
+		return vmFilePaths{}, prepStep("provision root disk", err)
+	}
 
 	return vmFilePaths{id, dstImgPath, fsExt4Path, stdoutPath, stderrPath}, nil
 }
 
-func setVMOpts(p vmFilePaths) (*options, error) {
+func createLogFiles(paths ...string) error {
+	for _, p := range paths {
+		err := os.MkdirAll(filepath.Dir(p), 0755)
+		if err != nil {
+			return err
+		}
+		file, err := os.Create(p)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	}
+	return nil
+}
+
+func setVMOpts(p vmFilePaths, spec vmSpec) (*options, error) {
+	jail := spec.jail
 	opts := newOptions()
+	opts.Id = p.id.String()
 	opts.FcBinary = "../../firecracker/release/firecracker"
 	opts.FcKernelImage = p.kernelImgPath
+	opts.FcKernelCmdLine = spec.image.BootArgs
 	opts.FcRootDrivePath = p.fsRootPath
-	opts.FcCPUCount = 1
-	opts.FcMemSz = 512
-	opts.FcSocketPath = "/tmp/firecracker-" + p.id.String() + ".socket"
-	CniNetworkName, err := GenerateCniConfFile(p.id)
+	opts.FcCPUCount = spec.shape.VCPUs
+	opts.FcMemSz = spec.shape.MemoryMib
+	if jail != nil {
+		// the socket path is resolved inside the chroot by the SDK
+		opts.JailerBinary = jail.cfg.Binary
+		opts.ExecFile = opts.FcBinary
+		opts.Uid = jail.uid
+		opts.Gid = jail.gid
+		opts.NumaNode = jail.cfg.NumaNode
+		opts.ChrootBaseDir = jail.cfg.ChrootBaseDir
+		opts.CgroupVersion = jail.cfg.CgroupVersion
+		opts.ParentCgroup = jail.cfg.ParentCgroup
+	} else {
+		opts.FcSocketPath = "/tmp/firecracker-" + p.id.String() + ".socket"
+	}
+	CniNetworkName, err := GenerateCniConfFile(p.id, spec.subnet)
 	if err != nil {
 		return nil, err
 	}
@@ -164,8 +235,8 @@ func runFirecrackerMachine(ctx context.Context, m *firecracker.Machine, ch chan<
 	}
 }
 
-// Run a vmm with a given set of options
-func setupFirecrackerMachine(ctx context.Context, opts *options) (*firecracker.Machine, error) {
+// Run a vmm with a given set of options, extra options are applied last
+func setupFirecrackerMachine(ctx context.Context, opts *options, extra ...firecracker.Opt) (*firecracker.Machine, error) {
 	// convert options to a firecracker config
 	fcCfg, err := opts.getFirecrackerConfig()
 	if err != nil {
@@ -202,18 +273,25 @@ func setupFirecrackerMachine(ctx context.Context, opts *options) (*firecracker.M
 		return nil, fmt.Errorf("binary, %q, is not executable. Check permissions of binary", firecrackerBinary)
 	}
 
-	// if the jailer is used, the final command will be built in NewMachine()
-	if fcCfg.JailerCfg == nil {
-		stdoutFile, err := os.OpenFile(opts.FcStdoutPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-		if err != nil {
-			return nil, fmt.Errorf("failed to open stdout file %s: %v", opts.FcStdoutPath, err)
-		}
+	stdoutFile, err := os.OpenFile(opts.FcStdoutPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdout file %s: %v", opts.FcStdoutPath, err)
+	}
 
-		stderrFile, err := os.OpenFile(opts.FcStderrPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	stderrFile, err := os.OpenFile(opts.FcStderrPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stderr file %s: %v", opts.FcStderrPath, err)
+	}
+
+	if fcCfg.JailerCfg != nil {
+		// NewMachine prepares the chroot and socket path, but the jailer
+		// command itself is replaced so cgroup limits can be passed
+		cmd, err := buildJailerCommand(ctx, opts, filepath.Join(netNSDir, fcCfg.VMID), stdoutFile, stderrFile)
 		if err != nil {
-			return nil, fmt.Errorf("failed to open stderr file %s: %v", opts.FcStderrPath, err)
+			return nil, err
 		}
-
+		machineOpts = append(machineOpts, firecracker.WithProcessRunner(cmd))
+	} else {
 		cmd := firecracker.VMCommandBuilder{}.
 			WithBin(firecrackerBinary).
 			WithSocketPath(fcCfg.SocketPath).
@@ -233,6 +311,7 @@ func setupFirecrackerMachine(ctx context.Context, opts *options) (*firecracker.M
 		machineOpts = append(machineOpts, firecracker.WithProcessRunner(cmd))
 	}
 
+	machineOpts = append(machineOpts, extra...)
 	m, err := firecracker.NewMachine(ctx, fcCfg, machineOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed creating machine: %s", err)
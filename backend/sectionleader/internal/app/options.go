@@ -70,6 +70,8 @@ type options struct {
 
 	ChrootBaseDir string `long:"chroot-base-dir" description:"Jailer chroot base directory"`
 	Daemonize     bool   `long:"daemonize" description:"Run jailer as daemon"`
+	CgroupVersion string `long:"cgroup-version" description:"Jailer cgroup version (1 or 2)"`
+	ParentCgroup  string `long:"parent-cgroup" description:"Jailer parent cgroup the VM cgroup is created under"`
 
 	closers []func() error
 	// validMetadata interface{}
@@ -131,10 +133,8 @@ func (opts *options) getFirecrackerConfig() (firecracker.Config, error) {
 			JailerBinary:   opts.JailerBinary,
 			ChrootBaseDir:  opts.ChrootBaseDir,
 			Daemonize:      opts.Daemonize,
-			ChrootStrategy: firecracker.NewNaiveChrootStrategy(opts.FcKernelImage),
-			Stdout:         os.Stdout,
-			Stderr:         os.Stderr,
-			Stdin:          os.Stdin,
+			ChrootStrategy: newJailChrootStrategy(opts.Uid, opts.Gid),
+			CgroupVersion:  opts.CgroupVersion,
 		}
 	} else {
 
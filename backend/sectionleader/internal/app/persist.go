@@ -0,0 +1,230 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
+)
+
+// machineRecord is what the store keeps for each machine.
+type machineRecord struct {
+	Data     MachineData `json:"data"`
+	State    VMState     `json:"state"`
+	JailSlot int         `json:"jail_slot"` // -1 when not jailed
+}
+
+// persist writes the VM to the store, must be called with manager.mutex held.
+func (manager *VMManager) persist(vmPtr *VM) {
+	if manager.store == nil {
+		return
+	}
+
+	rec := machineRecord{
+		Data:     vmPtr.data,
+		State:    vmPtr.State,
+		JailSlot: -1,
+	}
+	if vmPtr.jail != nil {
+		rec.JailSlot = vmPtr.jail.slot
+	}
+
+	value, err := json.Marshal(rec)
+	if err != nil {
+		logrus.Errorf("marshal machine record %s: %v", vmPtr.Id.String(), err)
+		return
+	}
+
+	err = manager.store.PutMachine(vmPtr.Id.String(), value)
+	if err != nil {
+		logrus.Errorf("persist machine %s: %v", vmPtr.Id.String(), err)
+	}
+}
+
+// LoadFromStore restores the machines recorded by a previous run. Machines
+// whose firecracker process is still alive are re-attached through their API
+// socket, the rest are marked stopped. Hibernated machines get their wake
+// listeners back.
+func (manager *VMManager) LoadFromStore() error {
+	if manager.store == nil {
+		return nil
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	err := manager.ports.Load()
+	if err != nil {
+		return err
+	}
+
+	err = manager.subnets.Load()
+	if err != nil {
+		return err
+	}
+
+	err = manager.Users.Load()
+	if err != nil {
+		return err
+	}
+
+	err = manager.Revocations.Load()
+	if err != nil {
+		return err
+	}
+
+	err = manager.AdminKeys.Load()
+	if err != nil {
+		return err
+	}
+
+	records, err := manager.store.ListMachines()
+	if err != nil {
+		return err
+	}
+
+	for key, value := range records {
+		var rec machineRecord
+		err = json.Unmarshal(value, &rec)
+		if err != nil {
+			logrus.Errorf("skipping malformed machine record %s: %v", key, err)
+			continue
+		}
+
+		id := rec.Data.Id
+		vmPtr := &VM{
+			Id:    id,
+			State: rec.State,
+			data:  rec.Data,
+		}
+
+		if rec.JailSlot >= 0 {
+			vmPtr.jail = &jailSpec{
+				slot: rec.JailSlot,
+				uid:  manager.cfg.Jailer.UidBase + rec.JailSlot,
+				gid:  manager.cfg.Jailer.GidBase + rec.JailSlot,
+				cfg:  manager.cfg.Jailer,
+			}
+		}
+
+		if vmPtr.State == StateActive || vmPtr.State == StatePaused {
+			ctx, cancelFunc := context.WithCancel(context.Background())
+			machine, err := attachMachine(ctx, rec.Data)
+			if err != nil {
+				cancelFunc()
+				logrus.Warnf("machine %s is no longer running, marking stopped: %v", id.String(), err)
+				vmPtr.State = StateStopped
+				manager.persist(vmPtr)
+			} else {
+				vmPtr.Machine = machine
+				vmPtr.cancel = cancelFunc
+				if vmPtr.jail != nil {
+					manager.jailSlots[vmPtr.jail.slot] = true
+				}
+			}
+		}
+
+		// records written before ports could be exposed only have the game port
+		if vmPtr.data.Shape.VCPUs == 0 {
+			// machines created before shapes were all small
+			vmPtr.data.Shape = sizeClasses["small"]
+		}
+		if vmPtr.data.ExpiresAt.IsZero() {
+			// machines created before leases get one from now
+			lease, err := manager.ResolveLease(vmPtr.data.Shape, 0)
+			if err == nil && lease != 0 {
+				vmPtr.data.ExpiresAt = leaseExpiry(lease)
+				manager.persist(vmPtr)
+			}
+		}
+		if len(vmPtr.data.ExposedPorts) == 0 && vmPtr.data.LocalPort != 0 {
+			vmPtr.data.ExposedPorts = []ExposedPort{{
+				GuestPort:  constants.InternalGamePort,
+				Protocol:   ProtocolTCP,
+				HostPort:   vmPtr.data.LocalPort,
+				PublicPort: vmPtr.data.GameRemotePort,
+			}}
+		}
+
+		manager.ports.Reserve(PortPoolSsh, rec.Data.RemotePort, id)
+		for i, p := range vmPtr.data.ExposedPorts {
+			if p.Protocol == "" {
+				vmPtr.data.ExposedPorts[i].Protocol = ProtocolTCP
+			}
+			manager.ports.Reserve(PortPoolForward, p.HostPort, id)
+			manager.ports.Reserve(PortPoolGame, p.PublicPort, id)
+		}
+
+		if _, subnet, err := net.ParseCIDR(rec.Data.Subnet); err == nil {
+			err = manager.subnets.Reserve(subnet, id)
+			if err != nil {
+				logrus.Errorf("could not reserve subnet of machine %s: %v", id.String(), err)
+			}
+		}
+
+		manager.IdNameMap.add(id, rec.Data.Name)
+		manager.VMs[id] = vmPtr
+		if vmPtr.State == StateHibernated {
+			manager.startWakeListeners(vmPtr)
+		}
+		logrus.Infof("loaded machine %s (%s) from store, state %d", id.String(), rec.Data.Name, vmPtr.State)
+	}
+
+	// the rest of what they held is removed by the reconciler
+	released := manager.subnets.ReleaseUnknown(func(id MachineUUID) bool {
+		_, ok := manager.VMs[id]
+		return ok
+	})
+	if released > 0 {
+		logrus.Infof("released subnets of %d machines without a record", released)
+	}
+
+	return nil
+}
+
+// attachMachine builds a Machine for a firecracker process started by a
+// previous run. It is driven only through the API socket, it is not Started.
+func attachMachine(ctx context.Context, data MachineData) (*firecracker.Machine, error) {
+	if data.Pid <= 0 {
+		return nil, fmt.Errorf("no pid recorded")
+	}
+	if err := syscall.Kill(data.Pid, 0); err != nil {
+		return nil, fmt.Errorf("process %d not running: %v", data.Pid, err)
+	}
+	if _, err := os.Stat(data.SocketPath); err != nil {
+		return nil, fmt.Errorf("api socket: %v", err)
+	}
+
+	proc, err := os.FindProcess(data.Pid)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := firecracker.Config{
+		SocketPath: data.SocketPath,
+		VMID:       data.Id.String(),
+	}
+	machine, err := firecracker.NewMachine(ctx, cfg,
+		firecracker.WithLogger(logrus.NewEntry(logrus.StandardLogger())),
+		firecracker.WithProcessRunner(&exec.Cmd{Process: proc}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	describeCtx, cancelFunc := context.WithTimeout(ctx, constants.DefaultTimeout)
+	defer cancelFunc()
+	_, err = machine.DescribeInstanceInfo(describeCtx)
+	if err != nil {
+		return nil, fmt.Errorf("describe instance: %v", err)
+	}
+
+	return machine, nil
+}
@@ -0,0 +1,132 @@
+package app
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// time to wait before retrying after a failed pool refill
+const poolRetryDelay = time.Second * 10
+
+// vmPool holds pre-booted VMs which have not been handed out yet. They have no
+// name, ports or port forwarding until they are claimed.
+type vmPool struct {
+	mutex    sync.Mutex
+	size     int
+	vms      []*VM
+	closed   bool
+	refillCh chan struct{}
+}
+
+func newVMPool(size int) *vmPool {
+	return &vmPool{
+		size:     size,
+		vms:      make([]*VM, 0, size),
+		refillCh: make(chan struct{}, 1),
+	}
+}
+
+// StartPool boots VMs in the background until the pool is full, and tops it
+// back up whenever a pooled VM is claimed.
+func (manager *VMManager) StartPool() {
+	if manager.pool.size == 0 {
+		return
+	}
+
+	logrus.Infof("starting vm pool with size %d", manager.pool.size)
+	shape := manager.DefaultShape()
+	go manager.pool.run(func() (*VM, error) {
+		img, err := manager.ResolveImage("")
+		if err != nil {
+			return nil, err
+		}
+		return manager.spawnVM(shape, img, nil)
+	}, manager.discardVM)
+	manager.pool.requestRefill()
+}
+
+// DrainPool stops refilling the pool and tears down the VMs waiting in it,
+// for when the server is exiting. The pool is not refilled afterwards.
+func (manager *VMManager) DrainPool() {
+	manager.pool.drain(manager.discardVM)
+}
+
+// claim takes a pooled VM, or returns nil if the pool is empty.
+func (p *vmPool) claim() *VM {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.vms) == 0 {
+		return nil
+	}
+
+	vmPtr := p.vms[0]
+	p.vms = p.vms[1:]
+	return vmPtr
+}
+
+func (p *vmPool) requestRefill() {
+	if p.size == 0 {
+		return
+	}
+
+	select {
+	case p.refillCh <- struct{}{}:
+	default:
+		// a refill is already pending
+	}
+}
+
+func (p *vmPool) needsVM() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return !p.closed && len(p.vms) < p.size
+}
+
+// run spawns VMs until the pool is full on every refill request. VMs spawned
+// after the pool was drained are handed to discard.
+func (p *vmPool) run(spawn func() (*VM, error), discard func(*VM)) {
+	for range p.refillCh {
+		for p.needsVM() {
+			vmPtr, err := spawn()
+			if err != nil {
+				logrus.Errorf("failed to spawn pooled vm: %v", err)
+				time.Sleep(poolRetryDelay)
+				continue
+			}
+
+			p.mutex.Lock()
+			if p.closed {
+				p.mutex.Unlock()
+				discard(vmPtr)
+				return
+			}
+			p.vms = append(p.vms, vmPtr)
+			logrus.Infof("added vm %s to pool, %d/%d ready", vmPtr.Id.String(), len(p.vms), p.size)
+			p.mutex.Unlock()
+		}
+	}
+}
+
+// drain stops refilling and hands every VM still waiting in the pool to
+// discard, which releases what it holds.
+func (p *vmPool) drain(discard func(*VM)) {
+	p.mutex.Lock()
+	p.closed = true
+	vms := p.vms
+	p.vms = nil
+	p.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, vmPtr := range vms {
+		wg.Add(1)
+		go func(vmPtr *VM) {
+			defer wg.Done()
+			discard(vmPtr)
+		}(vmPtr)
+	}
+	wg.Wait()
+}
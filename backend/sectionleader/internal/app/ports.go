@@ -0,0 +1,210 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/store"
+)
+
+type PortPool string
+
+const (
+	PortPoolSsh     PortPool = "ssh"     // public frp port for ssh
+	PortPoolForward PortPool = "forward" // host port DNATed to the guest
+	PortPoolGame    PortPool = "game"    // public frp port for the forwarded port
+)
+
+// CapacityError is returned when a resource has nothing left to hand out.
+type CapacityError struct {
+	Resource string
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("out of capacity: no free %s", e.Resource)
+}
+
+type portRange struct {
+	min int
+	max int
+	// whether the port is bound on this host, so it can be checked for
+	// other listeners before being handed out
+	checkHost bool
+}
+
+// PortAllocator hands out ports from the configured ranges and keeps track of
+// which machine owns each one.
+type PortAllocator struct {
+	mutex  sync.Mutex
+	ranges map[PortPool]portRange
+	used   map[PortPool]map[int]MachineUUID
+	store  *store.Store
+}
+
+func NewPortAllocator(db *store.Store) *PortAllocator {
+	a := &PortAllocator{
+		ranges: map[PortPool]portRange{
+			PortPoolSsh:     {constants.MinRemotePort, constants.MaxRemotePort, false},
+			PortPoolForward: {constants.MinLocalForwardPort, constants.MaxLocalForwardPort, true},
+			PortPoolGame:    {constants.MinGameRemotePort, constants.MaxGameRemotePort, false},
+		},
+		used:  make(map[PortPool]map[int]MachineUUID),
+		store: db,
+	}
+	for pool := range a.ranges {
+		a.used[pool] = make(map[int]MachineUUID)
+	}
+	return a
+}
+
+// Allocate reserves the lowest free port of the pool for owner. The protocol
+// is used to check whether the port is free on the host.
+func (a *PortAllocator) Allocate(pool PortPool, protocol Protocol, owner MachineUUID) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	r, ok := a.ranges[pool]
+	if !ok {
+		return 0, fmt.Errorf("unknown port pool %q", pool)
+	}
+
+	for port := r.min; port <= r.max; port++ {
+		if _, taken := a.used[pool][port]; taken {
+			continue
+		}
+		if r.checkHost && !hostPortFree(protocol, port) {
+			logrus.Warnf("%s port %d is in use by another process, skipping", protocol, port)
+			continue
+		}
+
+		a.used[pool][port] = owner
+		a.persist(pool, port, owner)
+		return port, nil
+	}
+
+	return 0, &CapacityError{Resource: string(pool) + " ports"}
+}
+
+// Reserve marks a port as owned without checking the host, used when loading
+// machines that already hold it.
+func (a *PortAllocator) Reserve(pool PortPool, port int, owner MachineUUID) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if _, ok := a.used[pool]; !ok || port == 0 {
+		return
+	}
+	a.used[pool][port] = owner
+	a.persist(pool, port, owner)
+}
+
+func (a *PortAllocator) Release(pool PortPool, port int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.release(pool, port)
+}
+
+// ReleaseAll frees every port owned by a machine.
+func (a *PortAllocator) ReleaseAll(owner MachineUUID) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for pool, ports := range a.used {
+		for port, id := range ports {
+			if id == owner {
+				a.release(pool, port)
+			}
+		}
+	}
+}
+
+func (a *PortAllocator) release(pool PortPool, port int) {
+	if _, ok := a.used[pool][port]; !ok {
+		return
+	}
+	delete(a.used[pool], port)
+
+	if a.store != nil {
+		err := a.store.Delete(store.BucketPorts, portKey(pool, port))
+		if err != nil {
+			logrus.Errorf("delete port allocation %s/%d: %v", pool, port, err)
+		}
+	}
+}
+
+// Load restores the allocations recorded in the store.
+func (a *PortAllocator) Load() error {
+	if a.store == nil {
+		return nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	values, err := a.store.List(store.BucketPorts)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range values {
+		poolStr, portStr, found := strings.Cut(key, "/")
+		port, err := strconv.Atoi(portStr)
+		if !found || err != nil {
+			logrus.Errorf("skipping malformed port allocation %q", key)
+			continue
+		}
+
+		var owner MachineUUID
+		err = owner.UnmarshalText(value)
+		if err != nil {
+			logrus.Errorf("skipping port allocation %q with malformed owner: %v", key, err)
+			continue
+		}
+
+		if _, ok := a.used[PortPool(poolStr)]; !ok {
+			continue
+		}
+		a.used[PortPool(poolStr)][port] = owner
+	}
+
+	return nil
+}
+
+func (a *PortAllocator) persist(pool PortPool, port int, owner MachineUUID) {
+	if a.store == nil {
+		return
+	}
+
+	err := a.store.Put(store.BucketPorts, portKey(pool, port), []byte(owner.String()))
+	if err != nil {
+		logrus.Errorf("persist port allocation %s/%d: %v", pool, port, err)
+	}
+}
+
+func portKey(pool PortPool, port int) string {
+	return string(pool) + "/" + strconv.Itoa(port)
+}
+
+func hostPortFree(protocol Protocol, port int) bool {
+	if protocol == ProtocolUDP {
+		conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(port))
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
@@ -0,0 +1,307 @@
+package app
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sshKeyName is the private key of a machine in its data dir, served by
+	// GET /ssh-key. Machines created before keys were ed25519 have id_rsa.
+	sshKeyName       = "id_ed25519"
+	legacySshKeyName = "id_rsa"
+)
+
+// PrepError is returned when preparing the files of a new VM fails, Step
+// names what was being done.
+type PrepError struct {
+	Step string
+	Err  error
+}
+
+func (e *PrepError) Error() string {
+	return fmt.Sprintf("prepare vm: %s: %v", e.Step, e.Err)
+}
+
+func (e *PrepError) Unwrap() error {
+	return e.Err
+}
+
+func prepStep(step string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PrepError{Step: step, Err: err}
+}
+
+// generateSSHKey writes a new ed25519 private key into dir and returns the
+// public key as an authorized_keys line.
+func generateSSHKey(dir string, comment string) ([]byte, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := ssh.MarshalPrivateKey(priv, comment)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(filepath.Join(dir, sshKeyName), pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	authorized := bytes.TrimSuffix(ssh.MarshalAuthorizedKey(sshPub), []byte("\n"))
+	authorized = append(authorized, " "+comment+"\n"...)
+
+	err = os.WriteFile(filepath.Join(dir, sshKeyName+".pub"), authorized, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return authorized, nil
+}
+
+// guestFile is a file or directory written into a root disk before boot.
+type guestFile struct {
+	path    string
+	dir     bool
+	content []byte
+	mode    uint32
+	uid     int
+	gid     int
+}
+
+// authorizedKeysFiles are ~/.ssh and ~/.ssh/authorized_keys of user, who must
+// exist in the /etc/passwd of the root disk.
+func authorizedKeysFiles(fsPath string, user string, keys []byte) ([]guestFile, error) {
+	passwd, err := debugfsCat(fsPath, "/etc/passwd")
+	if err != nil {
+		return nil, fmt.Errorf("read /etc/passwd: %v", err)
+	}
+	uid, gid, home, err := lookupPasswd(string(passwd), user)
+	if err != nil {
+		return nil, err
+	}
+
+	sshDir := path.Join(home, ".ssh")
+	return []guestFile{
+		{path: sshDir, dir: true, mode: 0700, uid: uid, gid: gid},
+		{path: path.Join(sshDir, "authorized_keys"), content: keys, mode: 0600, uid: uid, gid: gid},
+	}, nil
+}
+
+// injectFiles writes files into the unmounted ext4 at fsPath with debugfs,
+// replacing existing files. Directories are created if missing, their parents
+// must exist.
+func injectFiles(fsPath string, files []guestFile) error {
+	tmpDir, err := os.MkdirTemp("", "nimbus-inject-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var commands []string
+	for i, f := range files {
+		if strings.ContainsAny(f.path, "\"\n") {
+			return fmt.Errorf("unsupported path %q", f.path)
+		}
+		target := debugfsQuote(f.path)
+		exists := debugfsExists(fsPath, f.path)
+
+		if f.dir {
+			// debugfs corrupts the filesystem on mkdir of an existing
+			// directory, so only missing ones are created
+			if !exists {
+				commands = append(commands, "mkdir "+target)
+			}
+			commands = append(commands, setOwnerCommands(target, f.uid, f.gid, 040000|f.mode)...)
+			continue
+		}
+
+		// debugfs write copies from a host file
+		src := filepath.Join(tmpDir, strconv.Itoa(i))
+		err := os.WriteFile(src, f.content, 0600)
+		if err != nil {
+			return err
+		}
+		if exists {
+			commands = append(commands, "rm "+target)
+		}
+		commands = append(commands, "write "+debugfsQuote(src)+" "+target)
+		commands = append(commands, setOwnerCommands(target, f.uid, f.gid, 0100000|f.mode)...)
+	}
+
+	err = runDebugfs(fsPath, commands)
+	if err != nil {
+		return err
+	}
+
+	// debugfs does not fail on failed commands, so read the files back
+	for _, f := range files {
+		if f.dir {
+			if !debugfsExists(fsPath, f.path) {
+				return fmt.Errorf("%s does not exist after creating it", f.path)
+			}
+			continue
+		}
+		written, err := debugfsCat(fsPath, f.path)
+		if err != nil {
+			return fmt.Errorf("read back %s: %v", f.path, err)
+		}
+		if !bytes.Equal(written, f.content) {
+			return fmt.Errorf("%s does not hold the content after writing it", f.path)
+		}
+	}
+	return nil
+}
+
+// chownToRoot makes root the owner of every file of an ext4 that was built
+// from a tree extracted by another user, which mkfs.ext4 -d copies as is.
+func chownToRoot(fsPath string, tree string) error {
+	var commands []string
+	err := filepath.WalkDir(tree, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if ok && stat.Uid == 0 && stat.Gid == 0 {
+			return nil
+		}
+
+		rel, err := filepath.Rel(tree, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join("/", filepath.ToSlash(rel))
+		if strings.ContainsAny(target, "\"\n") {
+			return fmt.Errorf("unsupported path %q", target)
+		}
+		commands = append(commands,
+			fmt.Sprintf("set_inode_field %s uid 0", debugfsQuote(target)),
+			fmt.Sprintf("set_inode_field %s gid 0", debugfsQuote(target)),
+		)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return runDebugfs(fsPath, commands)
+}
+
+func setOwnerCommands(target string, uid int, gid int, mode uint32) []string {
+	return []string{
+		fmt.Sprintf("set_inode_field %s uid %d", target, uid),
+		fmt.Sprintf("set_inode_field %s gid %d", target, gid),
+		fmt.Sprintf("set_inode_field %s mode 0%o", target, mode),
+	}
+}
+
+// runDebugfs runs commands against the ext4 at fsPath in one debugfs session.
+func runDebugfs(fsPath string, commands []string) error {
+	if len(commands) == 0 {
+		return nil
+	}
+
+	scriptFile, err := os.CreateTemp("", "nimbus-debugfs-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(scriptFile.Name())
+	_, err = scriptFile.WriteString(strings.Join(commands, "\n") + "\n")
+	scriptFile.Close()
+	if err != nil {
+		return err
+	}
+
+	output, err := exec.Command("debugfs", "-w", "-f", scriptFile.Name(), fsPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("debugfs: %v, output: %s", err, output)
+	}
+	return nil
+}
+
+func debugfsCat(fsPath string, p string) ([]byte, error) {
+	return exec.Command("debugfs", "-R", "cat "+debugfsQuote(p), fsPath).Output()
+}
+
+// debugfsExists reports whether p exists in the unmounted ext4 at fsPath.
+func debugfsExists(fsPath string, p string) bool {
+	_, err := debugfsStat(fsPath, p)
+	return err == nil
+}
+
+var debugfsStatFields = regexp.MustCompile(`Type: (\w+)\s+Mode:\s+(\d+)(?s:.*)User:\s+(\d+)\s+Group:\s+(\d+)`)
+
+// debugfsStat returns the type, mode and owner of p in the unmounted ext4 at
+// fsPath as a guestFile without content.
+func debugfsStat(fsPath string, p string) (guestFile, error) {
+	output, err := exec.Command("debugfs", "-R", "stat "+debugfsQuote(p), fsPath).CombinedOutput()
+	if err != nil {
+		return guestFile{}, fmt.Errorf("debugfs: %v, output: %s", err, output)
+	}
+	// debugfs exits 0 for missing files, with only a message in the output
+	match := debugfsStatFields.FindSubmatch(output)
+	if match == nil {
+		return guestFile{}, fmt.Errorf("stat %s: %s", p, bytes.TrimSpace(output))
+	}
+
+	mode, err := strconv.ParseUint(string(match[2]), 8, 32)
+	if err != nil {
+		return guestFile{}, err
+	}
+	uid, err := strconv.Atoi(string(match[3]))
+	if err != nil {
+		return guestFile{}, err
+	}
+	gid, err := strconv.Atoi(string(match[4]))
+	if err != nil {
+		return guestFile{}, err
+	}
+	return guestFile{path: p, dir: string(match[1]) == "directory", mode: uint32(mode), uid: uid, gid: gid}, nil
+}
+
+func debugfsQuote(p string) string {
+	return "\"" + p + "\""
+}
+
+// lookupPasswd finds a user in the content of /etc/passwd.
+func lookupPasswd(passwd string, user string) (int, int, string, error) {
+	for _, line := range strings.Split(passwd, "\n") {
+		fields := strings.Split(line, ":")
+		if len(fields) < 7 || fields[0] != user {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("bad uid for %s: %v", user, err)
+		}
+		gid, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return 0, 0, "", fmt.Errorf("bad gid for %s: %v", user, err)
+		}
+		return uid, gid, fields[5], nil
+	}
+	return 0, 0, "", fmt.Errorf("user %s does not exist in the image", user)
+}
@@ -0,0 +1,216 @@
+package app
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPasswd = `root:x:0:0:root:/root:/bin/bash
+daemon:x:1:1:daemon:/usr/sbin:/usr/sbin/nologin
+ubuntu:x:1000:1001:Ubuntu:/home/ubuntu:/bin/bash
+short:x:1002:1002
+baduid:x:abc:1003::/home/baduid:/bin/sh
+badgid:x:1004:abc::/home/badgid:/bin/sh
+`
+
+func TestLookupPasswd(t *testing.T) {
+	tests := []struct {
+		name    string
+		passwd  string
+		user    string
+		uid     int
+		gid     int
+		home    string
+		wantErr string
+	}{
+		{name: "root", passwd: testPasswd, user: "root", uid: 0, gid: 0, home: "/root"},
+		{name: "regular user", passwd: testPasswd, user: "ubuntu", uid: 1000, gid: 1001, home: "/home/ubuntu"},
+		{name: "missing user", passwd: testPasswd, user: "nobody", wantErr: "does not exist"},
+		{name: "prefix of a user", passwd: testPasswd, user: "ubu", wantErr: "does not exist"},
+		{name: "too few fields", passwd: testPasswd, user: "short", wantErr: "does not exist"},
+		{name: "bad uid", passwd: testPasswd, user: "baduid", wantErr: "bad uid"},
+		{name: "bad gid", passwd: testPasswd, user: "badgid", wantErr: "bad gid"},
+		{name: "empty passwd", passwd: "", user: "root", wantErr: "does not exist"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid, gid, home, err := lookupPasswd(tt.passwd, tt.user)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookupPasswd: %v", err)
+			}
+			if uid != tt.uid || gid != tt.gid || home != tt.home {
+				t.Fatalf("got %d, %d, %q, want %d, %d, %q", uid, gid, home, tt.uid, tt.gid, tt.home)
+			}
+		})
+	}
+}
+
+// newTestRootDisk builds a small ext4 holding an /etc/passwd and the home of
+// the ubuntu user, like the root disk of an image.
+func newTestRootDisk(t *testing.T) string {
+	for _, tool := range []string{"debugfs", "mkfs.ext4"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s is not on PATH", tool)
+		}
+	}
+
+	dir := t.TempDir()
+	tree := filepath.Join(dir, "tree")
+	for _, d := range []string{"etc", "root", "home/ubuntu"} {
+		err := os.MkdirAll(filepath.Join(tree, d), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(tree, "etc/passwd"), []byte(testPasswd), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsPath := filepath.Join(dir, "fs.ext4")
+	output, err := exec.Command("mkfs.ext4", "-q", "-F", "-d", tree, fsPath, "8M").CombinedOutput()
+	if err != nil {
+		t.Fatalf("mkfs.ext4: %v, output: %s", err, output)
+	}
+	return fsPath
+}
+
+func checkGuestFile(t *testing.T, fsPath string, want guestFile) {
+	t.Helper()
+	got, err := debugfsStat(fsPath, want.path)
+	if err != nil {
+		t.Fatalf("stat %s: %v", want.path, err)
+	}
+	if got.dir != want.dir || got.mode != want.mode || got.uid != want.uid || got.gid != want.gid {
+		t.Fatalf("%s is dir %v, mode %o, owner %d:%d, want dir %v, mode %o, owner %d:%d",
+			want.path, got.dir, got.mode, got.uid, got.gid, want.dir, want.mode, want.uid, want.gid)
+	}
+	if want.dir {
+		return
+	}
+	content, err := debugfsCat(fsPath, want.path)
+	if err != nil {
+		t.Fatalf("cat %s: %v", want.path, err)
+	}
+	if !bytes.Equal(content, want.content) {
+		t.Fatalf("%s holds %q, want %q", want.path, content, want.content)
+	}
+}
+
+func TestInjectAuthorizedKeys(t *testing.T) {
+	fsPath := newTestRootDisk(t)
+	keys := []byte("ssh-ed25519 AAAA first\n")
+
+	files, err := authorizedKeysFiles(fsPath, "ubuntu", keys)
+	if err != nil {
+		t.Fatalf("authorizedKeysFiles: %v", err)
+	}
+	err = injectFiles(fsPath, files)
+	if err != nil {
+		t.Fatalf("injectFiles: %v", err)
+	}
+	checkGuestFile(t, fsPath, guestFile{path: "/home/ubuntu/.ssh", dir: true, mode: 0700, uid: 1000, gid: 1001})
+	checkGuestFile(t, fsPath, guestFile{path: "/home/ubuntu/.ssh/authorized_keys", content: keys, mode: 0600, uid: 1000, gid: 1001})
+
+	// a second injection, as on a cloned disk, replaces the file and keeps
+	// the existing directory
+	keys = []byte("ssh-ed25519 BBBB second\n")
+	files, err = authorizedKeysFiles(fsPath, "ubuntu", keys)
+	if err != nil {
+		t.Fatalf("authorizedKeysFiles: %v", err)
+	}
+	err = injectFiles(fsPath, files)
+	if err != nil {
+		t.Fatalf("second injectFiles: %v", err)
+	}
+	checkGuestFile(t, fsPath, guestFile{path: "/home/ubuntu/.ssh/authorized_keys", content: keys, mode: 0600, uid: 1000, gid: 1001})
+
+	if _, err := exec.LookPath("e2fsck"); err == nil {
+		output, err := exec.Command("e2fsck", "-fn", fsPath).CombinedOutput()
+		if err != nil {
+			t.Fatalf("filesystem is inconsistent after injecting: %v, output: %s", err, output)
+		}
+	}
+}
+
+func TestInjectFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   []guestFile
+		wantErr string
+	}{
+		{
+			name: "nested directories",
+			files: []guestFile{
+				{path: "/etc/nimbus", dir: true, mode: 0755},
+				{path: "/etc/nimbus/conf.d", dir: true, mode: 0750, uid: 1, gid: 1},
+				{path: "/etc/nimbus/conf.d/a.conf", content: []byte("a = 1\n"), mode: 0640, uid: 1, gid: 1},
+			},
+		},
+		{
+			name:  "path with spaces",
+			files: []guestFile{{path: "/root/my notes.txt", content: []byte("hello\n"), mode: 0644}},
+		},
+		{
+			name:  "empty file",
+			files: []guestFile{{path: "/root/empty", content: []byte{}, mode: 0600}},
+		},
+		{
+			name:  "existing directory",
+			files: []guestFile{{path: "/home/ubuntu", dir: true, mode: 0750, uid: 1000, gid: 1001}},
+		},
+		{
+			name:    "quote in path",
+			files:   []guestFile{{path: "/root/a\"b", content: []byte("x")}},
+			wantErr: "unsupported path",
+		},
+		{
+			name:    "missing parent",
+			files:   []guestFile{{path: "/nope/file", content: []byte("x"), mode: 0644}},
+			wantErr: "/nope/file does not hold the content",
+		},
+		{
+			name:    "missing parent of directory",
+			files:   []guestFile{{path: "/nope/dir", dir: true, mode: 0755}},
+			wantErr: "does not exist after creating it",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsPath := newTestRootDisk(t)
+
+			err := injectFiles(fsPath, tt.files)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("injectFiles: %v", err)
+			}
+			for _, f := range tt.files {
+				checkGuestFile(t, fsPath, f)
+			}
+		})
+	}
+}
+
+func TestAuthorizedKeysFilesUnknownUser(t *testing.T) {
+	fsPath := newTestRootDisk(t)
+
+	_, err := authorizedKeysFiles(fsPath, "nobody", []byte("key\n"))
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("error = %v, want the user to be missing", err)
+	}
+}
@@ -0,0 +1,164 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/config"
+)
+
+// QuotaError is returned when a user asks for more than their quota allows.
+type QuotaError struct {
+	Resource string
+	Limit    string
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("over quota: %s is limited to %s", e.Resource, e.Limit)
+}
+
+// Usage is what the machines of a user hold. Every machine counts, whatever
+// its state, until it is deleted.
+type Usage struct {
+	Machines  int   `json:"machines"`
+	VCPUs     int64 `json:"vcpus"`
+	MemoryMib int64 `json:"memory_mib"`
+}
+
+func (u *Usage) add(shape MachineShape, sign int) {
+	u.Machines += sign
+	u.VCPUs += int64(sign) * shape.VCPUs
+	u.MemoryMib += int64(sign) * shape.MemoryMib
+}
+
+// UserMachine is a machine as listed for its owner, or for admins.
+type UserMachine struct {
+	State VMState
+	Data  MachineData
+}
+
+// Quota returns the quota of a user, their own or the default one.
+func (manager *VMManager) Quota(owner UserUUID) config.QuotaConfig {
+	user, err := manager.Users.Get(owner)
+	if err == nil && user.Quota != nil {
+		return *user.Quota
+	}
+	return manager.cfg.Users.Quota
+}
+
+// AllowAnonymous reports whether machines can be created without an account.
+func (manager *VMManager) AllowAnonymous() bool {
+	return manager.cfg.Users.AllowAnonymous
+}
+
+// UserMachines returns the machines of a user, oldest first, and what they
+// hold.
+func (manager *VMManager) UserMachines(owner UserUUID) ([]UserMachine, Usage) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	var machines []UserMachine
+	for _, vmPtr := range manager.VMs {
+		if vmPtr.data.Owner == owner {
+			machines = append(machines, UserMachine{State: vmPtr.State, Data: vmPtr.data})
+		}
+	}
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].Data.CreationTime.Before(machines[j].Data.CreationTime)
+	})
+
+	return machines, manager.usage(owner)
+}
+
+// Machines returns every machine, oldest first.
+func (manager *VMManager) Machines() []UserMachine {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	machines := make([]UserMachine, 0, len(manager.VMs))
+	for _, vmPtr := range manager.VMs {
+		machines = append(machines, UserMachine{State: vmPtr.State, Data: vmPtr.data})
+	}
+	sort.Slice(machines, func(i, j int) bool {
+		return machines[i].Data.CreationTime.Before(machines[j].Data.CreationTime)
+	})
+	return machines
+}
+
+// MachineOwner returns the owner of a machine, zero if it was created without
+// an account.
+func (manager *VMManager) MachineOwner(id MachineUUID) (UserUUID, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		return UserUUID{}, ErrMachineNotFound
+	}
+	return vmPtr.data.Owner, nil
+}
+
+// usage counts the machines of owner and the ones being created for them,
+// must be called with manager.mutex held.
+func (manager *VMManager) usage(owner UserUUID) Usage {
+	usage := manager.pendingUsage[owner]
+	for _, vmPtr := range manager.VMs {
+		if vmPtr.data.Owner == owner {
+			usage.add(vmPtr.data.Shape, 1)
+		}
+	}
+	return usage
+}
+
+// reserveQuota checks that one more machine of shape with the given lease
+// fits in the quota of owner, and counts it against the quota until release
+// is called, by when the machine is registered or has failed.
+func (manager *VMManager) reserveQuota(owner UserUUID, shape MachineShape, lease time.Duration) (release func(), err error) {
+	quota := manager.Quota(owner)
+
+	err = checkLeaseQuota(quota, lease)
+	if err != nil {
+		return nil, err
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	usage := manager.usage(owner)
+	usage.add(shape, 1)
+	switch {
+	case quota.MaxMachines != 0 && usage.Machines > quota.MaxMachines:
+		return nil, &QuotaError{Resource: "machines", Limit: fmt.Sprint(quota.MaxMachines)}
+	case quota.MaxVCPUs != 0 && usage.VCPUs > quota.MaxVCPUs:
+		return nil, &QuotaError{Resource: "vcpus", Limit: fmt.Sprint(quota.MaxVCPUs)}
+	case quota.MaxMemoryMib != 0 && usage.MemoryMib > quota.MaxMemoryMib:
+		return nil, &QuotaError{Resource: "memory", Limit: fmt.Sprintf("%d MiB", quota.MaxMemoryMib)}
+	}
+
+	pending := manager.pendingUsage[owner]
+	pending.add(shape, 1)
+	manager.pendingUsage[owner] = pending
+
+	return func() {
+		manager.mutex.Lock()
+		defer manager.mutex.Unlock()
+
+		pending := manager.pendingUsage[owner]
+		pending.add(shape, -1)
+		if pending.Machines == 0 {
+			delete(manager.pendingUsage, owner)
+		} else {
+			manager.pendingUsage[owner] = pending
+		}
+	}, nil
+}
+
+// checkLeaseQuota checks a lease against the longest one the quota allows, a
+// zero lease never expires so it only fits without a limit.
+func checkLeaseQuota(quota config.QuotaConfig, lease time.Duration) error {
+	if quota.MaxLease != 0 && (lease == 0 || lease > quota.MaxLease) {
+		return &QuotaError{Resource: "lease", Limit: quota.MaxLease.String()}
+	}
+	return nil
+}
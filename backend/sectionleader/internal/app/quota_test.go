@@ -0,0 +1,137 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/config"
+)
+
+func newQuotaTestManager(quota config.QuotaConfig) *VMManager {
+	return &VMManager{
+		cfg:          config.Config{Users: config.UsersConfig{Quota: quota}},
+		Users:        NewUserRegistry(nil),
+		VMs:          make(map[MachineUUID]*VM),
+		pendingUsage: make(map[UserUUID]Usage),
+	}
+}
+
+func TestReserveQuotaConcurrent(t *testing.T) {
+	tests := []struct {
+		name     string
+		quota    config.QuotaConfig
+		shape    MachineShape
+		want     int
+		resource string
+	}{
+		{name: "machines", quota: config.QuotaConfig{MaxMachines: 3}, shape: MachineShape{VCPUs: 1, MemoryMib: 512}, want: 3, resource: "machines"},
+		{name: "vcpus", quota: config.QuotaConfig{MaxVCPUs: 5}, shape: MachineShape{VCPUs: 2, MemoryMib: 512}, want: 2, resource: "vcpus"},
+		{name: "memory", quota: config.QuotaConfig{MaxMemoryMib: 2048}, shape: MachineShape{VCPUs: 1, MemoryMib: 1024}, want: 2, resource: "memory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manager := newQuotaTestManager(tt.quota)
+			owner := UserUUID(uuid.New())
+
+			var mutex sync.Mutex
+			var releases []func()
+			var wg sync.WaitGroup
+			for range 20 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					release, err := manager.reserveQuota(owner, tt.shape, time.Hour)
+					var quotaErr *QuotaError
+					if errors.As(err, &quotaErr) {
+						if quotaErr.Resource != tt.resource {
+							t.Errorf("over quota on %s, want %s", quotaErr.Resource, tt.resource)
+						}
+						return
+					}
+					if err != nil {
+						t.Errorf("reserve: %v", err)
+						return
+					}
+					mutex.Lock()
+					releases = append(releases, release)
+					mutex.Unlock()
+				}()
+			}
+			wg.Wait()
+
+			if len(releases) != tt.want {
+				t.Fatalf("%d reservations succeeded, want %d", len(releases), tt.want)
+			}
+
+			// releasing one frees a slot for the next create
+			releases[0]()
+			release, err := manager.reserveQuota(owner, tt.shape, time.Hour)
+			if err != nil {
+				t.Fatalf("reserve after release: %v", err)
+			}
+			_, err = manager.reserveQuota(owner, tt.shape, time.Hour)
+			if err == nil {
+				t.Fatal("reserve over quota after release succeeded")
+			}
+
+			release()
+			for _, release := range releases[1:] {
+				release()
+			}
+			if len(manager.pendingUsage) != 0 {
+				t.Fatalf("pending usage left after every release: %+v", manager.pendingUsage)
+			}
+		})
+	}
+}
+
+func TestReserveQuotaCountsMachines(t *testing.T) {
+	manager := newQuotaTestManager(config.QuotaConfig{MaxMachines: 2})
+	owner := UserUUID(uuid.New())
+	other := UserUUID(uuid.New())
+	shape := MachineShape{VCPUs: 1, MemoryMib: 512}
+
+	id := MachineUUID(uuid.New())
+	manager.VMs[id] = &VM{Id: id, data: MachineData{Id: id, Owner: owner, Shape: shape}}
+	otherId := MachineUUID(uuid.New())
+	manager.VMs[otherId] = &VM{Id: otherId, data: MachineData{Id: otherId, Owner: other, Shape: shape}}
+
+	release, err := manager.reserveQuota(owner, shape, time.Hour)
+	if err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	defer release()
+
+	_, err = manager.reserveQuota(owner, shape, time.Hour)
+	var quotaErr *QuotaError
+	if !errors.As(err, &quotaErr) {
+		t.Fatalf("error = %v, want a *QuotaError", err)
+	}
+
+	usage := manager.usage(owner)
+	if usage.Machines != 2 || usage.VCPUs != 2 || usage.MemoryMib != 1024 {
+		t.Fatalf("usage = %+v, want the machine and the pending create", usage)
+	}
+}
+
+func TestReserveQuotaLease(t *testing.T) {
+	manager := newQuotaTestManager(config.QuotaConfig{MaxLease: 24 * time.Hour})
+	owner := UserUUID(uuid.New())
+	shape := MachineShape{VCPUs: 1, MemoryMib: 512}
+
+	for _, lease := range []time.Duration{0, 48 * time.Hour} {
+		_, err := manager.reserveQuota(owner, shape, lease)
+		var quotaErr *QuotaError
+		if !errors.As(err, &quotaErr) || quotaErr.Resource != "lease" {
+			t.Fatalf("lease %v: error = %v, want over quota on lease", lease, err)
+		}
+	}
+	release, err := manager.reserveQuota(owner, shape, time.Hour)
+	if err != nil {
+		t.Fatalf("reserve within the lease quota: %v", err)
+	}
+	release()
+}
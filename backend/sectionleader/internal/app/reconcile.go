@@ -0,0 +1,462 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
+)
+
+const (
+	cniIpamDir = "/var/lib/cni/networks"
+
+	// how long a leftover firecracker gets to exit after SIGTERM before it is
+	// killed
+	orphanKillTimeout = time.Second * 5
+)
+
+type ReconcileAction string
+
+const (
+	ActionKept    ReconcileAction = "kept"
+	ActionAdopted ReconcileAction = "adopted"
+	ActionRemoved ReconcileAction = "removed"
+	ActionFailed  ReconcileAction = "failed"
+)
+
+// ReconcileEntry is one resource the reconciler looked at.
+type ReconcileEntry struct {
+	Kind     string
+	Resource string
+	Action   ReconcileAction
+	Err      error
+}
+
+type ReconcileReport struct {
+	Entries []ReconcileEntry
+}
+
+func (r *ReconcileReport) add(kind string, resource string, action ReconcileAction, err error) {
+	if err != nil {
+		action = ActionFailed
+	}
+	r.Entries = append(r.Entries, ReconcileEntry{kind, resource, action, err})
+
+	if err != nil {
+		logrus.Errorf("reconcile %s %s: %v", kind, resource, err)
+	} else {
+		logrus.Infof("reconcile %s %s: %s", kind, resource, action)
+	}
+}
+
+// Count returns how many entries ended with the given action.
+func (r *ReconcileReport) Count(action ReconcileAction) int {
+	count := 0
+	for _, e := range r.Entries {
+		if e.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *ReconcileReport) String() string {
+	return fmt.Sprintf("%d kept, %d adopted, %d removed, %d failed",
+		r.Count(ActionKept), r.Count(ActionAdopted), r.Count(ActionRemoved), r.Count(ActionFailed))
+}
+
+// Reconcile looks for resources left behind by a previous run, which crashed
+// or was killed before it could clean up. Resources belonging to a known
+// machine are adopted or kept, everything else is torn down. It must run after
+// LoadFromStore and before any new VM is created.
+func (manager *VMManager) Reconcile() *ReconcileReport {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	report := &ReconcileReport{}
+
+	manager.reconcileProcesses(report)
+	manager.reconcileSockets(report)
+	manager.reconcileForwarding(report)
+	manager.reconcileVeths(report)
+	manager.reconcileCniConfs(report)
+	manager.reconcileNetNS(report)
+	manager.ingress.Reconcile(manager.published, report)
+	manager.reconcileDataDirs(report)
+	manager.reconcileJailDirs(report)
+
+	logrus.Infof("reconcile finished: %s", report.String())
+	return report
+}
+
+// running reports whether id is a known machine with a live VMM.
+func (manager *VMManager) running(id MachineUUID) bool {
+	vmPtr, ok := manager.VMs[id]
+	return ok && vmPtr.State != StateStopped && vmPtr.Machine != nil
+}
+
+// published reports whether what the ingress published for id is kept,
+// hibernated machines stay published so connections can wake them.
+func (manager *VMManager) published(id MachineUUID) bool {
+	vmPtr, ok := manager.VMs[id]
+	return manager.running(id) || (ok && vmPtr.State == StateHibernated)
+}
+
+func (manager *VMManager) known(id MachineUUID) bool {
+	_, ok := manager.VMs[id]
+	return ok
+}
+
+func (manager *VMManager) runningByIp(ip net.IP) bool {
+	for _, vmPtr := range manager.VMs {
+		if vmPtr.State != StateStopped && vmPtr.Machine != nil && vmPtr.data.LocalIp.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseMachineId(s string) (MachineUUID, bool) {
+	id, err := uuid.Parse(s)
+	if err != nil {
+		return MachineUUID{}, false
+	}
+	return MachineUUID(id), true
+}
+
+func (manager *VMManager) reconcileProcesses(report *ReconcileReport) {
+	procs, err := findFirecrackerProcesses(manager.cfg.Jailer.ChrootBaseDir)
+	if err != nil {
+		report.add("process", "/proc", ActionFailed, err)
+		return
+	}
+
+	for _, proc := range procs {
+		resource := fmt.Sprintf("%d (%s)", proc.pid, proc.id.String())
+
+		vmPtr, ok := manager.VMs[proc.id]
+		if ok && vmPtr.Machine != nil && vmPtr.State != StateStopped && vmPtr.data.Pid == proc.pid {
+			report.add("process", resource, ActionKept, nil)
+			continue
+		}
+
+		if ok && proc.socketPath != "" {
+			data := vmPtr.data
+			data.Pid = proc.pid
+			data.SocketPath = proc.socketPath
+
+			ctx, cancelFunc := context.WithCancel(context.Background())
+			machine, err := attachMachine(ctx, data)
+			if err == nil {
+				vmPtr.Machine = machine
+				vmPtr.cancel = cancelFunc
+				vmPtr.data = data
+				vmPtr.State = StateActive
+				if vmPtr.jail != nil {
+					manager.jailSlots[vmPtr.jail.slot] = true
+				}
+				manager.persist(vmPtr)
+				report.add("process", resource, ActionAdopted, nil)
+				continue
+			}
+			cancelFunc()
+			logrus.Warnf("could not adopt firecracker %d: %v", proc.pid, err)
+		}
+
+		report.add("process", resource, ActionRemoved, killProcess(proc.pid))
+	}
+}
+
+type firecrackerProcess struct {
+	pid        int
+	id         MachineUUID
+	socketPath string
+}
+
+// findFirecrackerProcesses scans /proc for firecracker VMMs that were started
+// by nimbus, identified by their --id argument or their socket name.
+func findFirecrackerProcesses(chrootBaseDir string) ([]firecrackerProcess, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	var procs []firecrackerProcess
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		comm, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+		if err != nil || strings.TrimSpace(string(comm)) != "firecracker" {
+			continue
+		}
+
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err != nil {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+
+		proc := firecrackerProcess{pid: pid}
+		found := false
+		var apiSock string
+		for i := 0; i+1 < len(args); i++ {
+			switch args[i] {
+			case "--id":
+				proc.id, found = parseMachineId(args[i+1])
+			case "--api-sock":
+				apiSock = args[i+1]
+			}
+		}
+
+		if !found {
+			name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(apiSock), "firecracker-"), ".socket")
+			proc.id, found = parseMachineId(name)
+		}
+		if !found {
+			continue
+		}
+
+		if strings.HasPrefix(apiSock, "/tmp/") {
+			proc.socketPath = apiSock
+		} else if apiSock != "" {
+			// jailed, the socket path is relative to the chroot
+			root, err := os.Readlink(filepath.Join("/proc", entry.Name(), "root"))
+			if err != nil {
+				root = jailRootPath(chrootBaseDir, "firecracker", proc.id)
+			}
+			proc.socketPath = filepath.Join(root, apiSock)
+		}
+
+		procs = append(procs, proc)
+	}
+
+	return procs, nil
+}
+
+func killProcess(pid int) error {
+	err := syscall.Kill(pid, syscall.SIGTERM)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(orphanKillTimeout)
+	for time.Now().Before(deadline) {
+		if syscall.Kill(pid, 0) != nil {
+			return nil
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
+
+func (manager *VMManager) reconcileSockets(report *ReconcileReport) {
+	paths, err := filepath.Glob("/tmp/firecracker-*.socket")
+	if err != nil {
+		report.add("socket", "/tmp", ActionFailed, err)
+		return
+	}
+
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "firecracker-"), ".socket")
+		id, ok := parseMachineId(name)
+		if ok && manager.running(id) {
+			report.add("socket", path, ActionKept, nil)
+			continue
+		}
+		report.add("socket", path, ActionRemoved, os.Remove(path))
+	}
+}
+
+// reconcileForwarding removes port mappings pointing at VM IPs that no
+// running machine owns.
+func (manager *VMManager) reconcileForwarding(report *ReconcileReport) {
+	mappings, err := manager.forwarder.List()
+	if err != nil {
+		report.add("forwarding", manager.forwarder.Name(), ActionFailed, err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range mappings {
+		if !manager.subnets.Contains(m.VMIp) || seen[m.VMIp.String()] {
+			continue
+		}
+		seen[m.VMIp.String()] = true
+
+		resource := manager.forwarder.Name() + ": " + m.VMIp.String()
+		if manager.runningByIp(m.VMIp) {
+			report.add("forwarding", resource, ActionKept, nil)
+			continue
+		}
+		report.add("forwarding", resource, ActionRemoved, manager.forwarder.Apply(m.VMIp, nil))
+	}
+}
+
+// reconcileVeths removes host veths created by the CNI ptp plugin whose /30
+// no longer belongs to a running machine.
+func (manager *VMManager) reconcileVeths(report *ReconcileReport) {
+	output, err := exec.Command("ip", "-o", "-4", "addr", "show").CombinedOutput()
+	if err != nil {
+		report.add("veth", "ip addr", ActionFailed, fmt.Errorf("%v, output: %s", err, output))
+		return
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[2] != "inet" {
+			continue
+		}
+
+		iface := strings.Split(fields[1], "@")[0]
+		if !strings.HasPrefix(iface, "veth") {
+			continue
+		}
+
+		hostIp, _, err := net.ParseCIDR(fields[3])
+		if err != nil || !manager.subnets.Contains(hostIp) {
+			continue
+		}
+
+		subnet := hostIp.Mask(net.CIDRMask(30, 32))
+		inUse := false
+		for _, vmPtr := range manager.VMs {
+			if vmPtr.State != StateStopped && vmPtr.Machine != nil && vmPtr.data.LocalIp.IP.Mask(net.CIDRMask(30, 32)).Equal(subnet) {
+				inUse = true
+				break
+			}
+		}
+
+		if inUse {
+			report.add("veth", iface, ActionKept, nil)
+			continue
+		}
+
+		output, err := exec.Command("ip", "link", "delete", iface).CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("%v, output: %s", err, output)
+		}
+		report.add("veth", iface, ActionRemoved, err)
+	}
+}
+
+// reconcileCniConfs removes conflists and IPAM leases of machines that are no
+// longer known. Stopped machines keep theirs.
+func (manager *VMManager) reconcileCniConfs(report *ReconcileReport) {
+	paths, err := filepath.Glob(CniConfRootDir + "/fcnet-*.conflist")
+	if err != nil {
+		report.add("cni conflist", CniConfRootDir, ActionFailed, err)
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "fcnet-"), ".conflist")
+		id, ok := parseMachineId(name)
+		if ok && manager.known(id) {
+			report.add("cni conflist", path, ActionKept, nil)
+			continue
+		}
+		report.add("cni conflist", path, ActionRemoved, os.Remove(path))
+	}
+
+	dirs, err := filepath.Glob(cniIpamDir + "/fcnet-*")
+	if err != nil {
+		report.add("cni lease", cniIpamDir, ActionFailed, err)
+	}
+	for _, dir := range dirs {
+		id, ok := parseMachineId(strings.TrimPrefix(filepath.Base(dir), "fcnet-"))
+		if ok && manager.running(id) {
+			report.add("cni lease", dir, ActionKept, nil)
+			continue
+		}
+		report.add("cni lease", dir, ActionRemoved, os.RemoveAll(dir))
+	}
+}
+
+func (manager *VMManager) reconcileNetNS(report *ReconcileReport) {
+	entries, err := os.ReadDir(netNSDir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		report.add("netns", netNSDir, ActionFailed, err)
+		return
+	}
+
+	for _, entry := range entries {
+		id, ok := parseMachineId(entry.Name())
+		if !ok {
+			continue
+		}
+		if manager.running(id) {
+			report.add("netns", entry.Name(), ActionKept, nil)
+			continue
+		}
+
+		output, err := exec.Command("ip", "netns", "delete", entry.Name()).CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("%v, output: %s", err, output)
+		}
+		report.add("netns", entry.Name(), ActionRemoved, err)
+	}
+}
+
+func (manager *VMManager) reconcileDataDirs(report *ReconcileReport) {
+	entries, err := os.ReadDir(constants.DataDirPath)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		report.add("data dir", constants.DataDirPath, ActionFailed, err)
+		return
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(constants.DataDirPath, entry.Name())
+		id, ok := parseMachineId(entry.Name())
+		if !ok {
+			continue
+		}
+		if manager.known(id) {
+			report.add("data dir", path, ActionKept, nil)
+			continue
+		}
+		report.add("data dir", path, ActionRemoved, os.RemoveAll(path))
+	}
+}
+
+func (manager *VMManager) reconcileJailDirs(report *ReconcileReport) {
+	jailDir := filepath.Join(manager.cfg.Jailer.ChrootBaseDir, "firecracker")
+	entries, err := os.ReadDir(jailDir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		report.add("jail", jailDir, ActionFailed, err)
+		return
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(jailDir, entry.Name())
+		id, ok := parseMachineId(entry.Name())
+		if !ok {
+			continue
+		}
+		if manager.running(id) {
+			report.add("jail", path, ActionKept, nil)
+			continue
+		}
+		report.add("jail", path, ActionRemoved, os.RemoveAll(path))
+	}
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/store"
+)
+
+var ErrAlreadyRevoked = errors.New("token was revoked already")
+
+// RevocationList holds the ids of revoked tokens until the tokens expire, after
+// which they are rejected anyway.
+type RevocationList struct {
+	mutex   sync.Mutex
+	revoked map[string]time.Time
+	store   *store.Store
+}
+
+func NewRevocationList(db *store.Store) *RevocationList {
+	return &RevocationList{
+		revoked: make(map[string]time.Time),
+		store:   db,
+	}
+}
+
+// Revoke rejects the token with the given id from now until expiry, it
+// returns ErrAlreadyRevoked if it was. A token that must only be used once is
+// used by whoever revokes it first.
+func (l *RevocationList) Revoke(id string, expiry time.Time) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.revoked[id]; ok {
+		return ErrAlreadyRevoked
+	}
+	l.prune(time.Now())
+	if l.store != nil {
+		value, err := expiry.MarshalText()
+		if err != nil {
+			return err
+		}
+		err = l.store.Put(store.BucketRevoked, id, value)
+		if err != nil {
+			return err
+		}
+	}
+	l.revoked[id] = expiry
+	return nil
+}
+
+func (l *RevocationList) IsRevoked(id string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	_, ok := l.revoked[id]
+	return ok
+}
+
+// Load restores the revocations recorded in the store.
+func (l *RevocationList) Load() error {
+	if l.store == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	values, err := l.store.List(store.BucketRevoked)
+	if err != nil {
+		return err
+	}
+
+	for id, value := range values {
+		var expiry time.Time
+		err = expiry.UnmarshalText(value)
+		if err != nil {
+			logrus.Errorf("skipping malformed token revocation %s: %v", id, err)
+			continue
+		}
+		l.revoked[id] = expiry
+	}
+	l.prune(time.Now())
+
+	return nil
+}
+
+// prune forgets the tokens that have expired, must be called with l.mutex
+// held.
+func (l *RevocationList) prune(now time.Time) {
+	for id, expiry := range l.revoked {
+		if expiry.After(now) {
+			continue
+		}
+		delete(l.revoked, id)
+		if l.store != nil {
+			err := l.store.Delete(store.BucketRevoked, id)
+			if err != nil {
+				logrus.Errorf("delete expired token revocation %s: %v", id, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/images"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	CloneAuto    = "auto"
+	CloneReflink = "reflink"
+	CloneSparse  = "sparse"
+
+	// sparse copies skip blocks of this size that are all zero
+	sparseBlockSize = 64 * 1024
+)
+
+// rootfsProvisioner builds the ext4 root disk of every image once, from its
+// squashfs, and gives every VM a clone of it. Clones are reflinks where the
+// filesystem supports them and sparse copies otherwise, then grown to the
+// disk size of the machine. Device-mapper snapshots are not used, as a
+// snapshot can not be larger than its origin.
+type rootfsProvisioner struct {
+	mutex    sync.Mutex
+	cacheDir string
+	mode     string
+}
+
+// baseInfo is stored next to a base image, to compare clone times against
+// the time a full build takes.
+type baseInfo struct {
+	BuildTime time.Duration `json:"build_time"`
+}
+
+func newRootfsProvisioner(cacheDir string, mode string) (*rootfsProvisioner, error) {
+	err := os.MkdirAll(cacheDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &rootfsProvisioner{cacheDir: cacheDir, mode: mode}
+	if mode == CloneAuto {
+		p.mode = CloneSparse
+		if reflinkSupported(cacheDir) {
+			p.mode = CloneReflink
+		}
+	}
+	logrus.Infof("root disks are %s clones of the images in %s", p.mode, cacheDir)
+	return p, nil
+}
+
+// reflinkSupported tries to reflink a scratch file inside dir.
+func reflinkSupported(dir string) bool {
+	src, err := os.CreateTemp(dir, ".reflink-probe-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+	src.Write([]byte("probe"))
+
+	dst, err := os.CreateTemp(dir, ".reflink-probe-")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())) == nil
+}
+
+// provision writes the root disk of a VM to dst, sizeMib large, with keys as
+// the authorized_keys of user.
+func (p *rootfsProvisioner) provision(img images.Image, dst string, sizeMib int64, user string, keys []byte) error {
+	base, info, err := p.baseImage(img)
+	if err != nil {
+		return fmt.Errorf("build base image: %v", err)
+	}
+
+	start := time.Now()
+	err = p.clone(base, dst)
+	if err != nil {
+		return fmt.Errorf("%s clone: %v", p.mode, err)
+	}
+	cloneTime := time.Since(start)
+
+	err = growExt4(dst, sizeMib)
+	if err != nil {
+		return fmt.Errorf("grow root disk: %v", err)
+	}
+
+	files, err := authorizedKeysFiles(dst, user, keys)
+	if err == nil {
+		err = injectFiles(dst, files)
+	}
+	if err != nil {
+		return fmt.Errorf("inject authorized_keys: %v", err)
+	}
+	total := time.Since(start)
+
+	logrus.Infof("root disk %s: %s clone took %v, %v with resize and key, a full unsquashfs and mkfs of image %s takes %v",
+		dst, p.mode, cloneTime.Round(time.Millisecond), total.Round(time.Millisecond), img.Name, info.BuildTime.Round(time.Millisecond))
+	return nil
+}
+
+// baseImage returns the ext4 build of an image, building it on first use.
+// Builds are keyed by the rootfs checksum, so a changed image is rebuilt.
+func (p *rootfsProvisioner) baseImage(img images.Image) (string, baseInfo, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	base := filepath.Join(p.cacheDir, fmt.Sprintf("%s-%.12s.ext4", img.Name, img.RootfsSha256))
+	infoPath := base + ".json"
+
+	var info baseInfo
+	_, err := os.Stat(base)
+	if err == nil {
+		infoBytes, err := os.ReadFile(infoPath)
+		if err == nil {
+			json.Unmarshal(infoBytes, &info)
+		}
+		return base, info, nil
+	}
+
+	start := time.Now()
+	err = buildBaseImage(img, base)
+	if err != nil {
+		return "", baseInfo{}, err
+	}
+	info.BuildTime = time.Since(start)
+	logrus.Infof("built base root disk of image %s in %v", img.Name, info.BuildTime.Round(time.Millisecond))
+
+	infoBytes, err := json.Marshal(info)
+	if err == nil {
+		os.WriteFile(infoPath, infoBytes, 0644)
+	}
+	return base, info, nil
+}
+
+// buildBaseImage is what every create used to do: extract the squashfs and
+// make an ext4 of it, owned by root. The result is renamed into place once
+// complete.
+func buildBaseImage(img images.Image, base string) error {
+	workDir, err := os.MkdirTemp(filepath.Dir(base), ".build-"+img.Name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDir)
+
+	extracted := filepath.Join(workDir, "squashfs-root")
+	tmpImage := filepath.Join(workDir, "fs.ext4")
+	steps := [][]string{
+		{"unsquashfs", "-d", extracted, img.Rootfs},
+		{"truncate", "-s", fmt.Sprintf("%dM", minDiskMib), tmpImage},
+		{"mkfs.ext4", "-q", "-d", extracted, "-F", tmpImage},
+	}
+	for _, step := range steps {
+		output, err := exec.Command(step[0], step[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %v, output: %s", strings.Join(step, " "), err, output)
+		}
+	}
+
+	err = chownToRoot(tmpImage, extracted)
+	if err != nil {
+		return fmt.Errorf("chown to root: %v", err)
+	}
+
+	return os.Rename(tmpImage, base)
+}
+
+func (p *rootfsProvisioner) clone(base string, dst string) error {
+	src, err := os.Open(base)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if p.mode == CloneReflink {
+		return unix.IoctlFileClone(int(out.Fd()), int(src.Fd()))
+	}
+	return sparseCopy(out, src)
+}
+
+// sparseCopy copies src to dst, leaving holes where src has zero blocks.
+func sparseCopy(dst *os.File, src *os.File) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, sparseBlockSize)
+	zero := make([]byte, sparseBlockSize)
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zero[:n]) {
+				_, err = dst.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, err = dst.Write(buf[:n])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// a trailing hole is only created by setting the size
+	return dst.Truncate(info.Size())
+}
+
+// growExt4 extends a clone to the disk size of the machine.
+func growExt4(fsPath string, sizeMib int64) error {
+	info, err := os.Stat(fsPath)
+	if err != nil {
+		return err
+	}
+	size := sizeMib * 1024 * 1024
+	if size <= info.Size() {
+		return nil
+	}
+
+	err = os.Truncate(fsPath, size)
+	if err != nil {
+		return err
+	}
+	steps := [][]string{
+		// resize2fs wants a freshly checked filesystem
+		{"e2fsck", "-fp", fsPath},
+		{"resize2fs", fsPath},
+	}
+	for _, step := range steps {
+		output, err := exec.Command(step[0], step[1:]...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %v, output: %s", strings.Join(step, " "), err, output)
+		}
+	}
+	return nil
+}
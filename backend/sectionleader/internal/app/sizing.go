@@ -0,0 +1,96 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/config"
+)
+
+const (
+	// smallest guest memory and root disk a machine boots with
+	minMemoryMib = 128
+	minDiskMib   = 400
+)
+
+var ErrInvalidShape = errors.New("invalid machine shape")
+
+// MachineShape is the size of a machine. Class is empty if the shape was
+// given as explicit values.
+type MachineShape struct {
+	Class     string `json:"size_class,omitempty"`
+	VCPUs     int64  `json:"vcpus"`
+	MemoryMib int64  `json:"memory_mib"`
+	DiskMib   int64  `json:"disk_mib"`
+}
+
+// sizeClasses are the named shapes, small is what every machine got before
+// shapes could be chosen.
+var sizeClasses = map[string]MachineShape{
+	"small":  {Class: "small", VCPUs: 1, MemoryMib: 512, DiskMib: 400},
+	"medium": {Class: "medium", VCPUs: 2, MemoryMib: 1024, DiskMib: 1024},
+	"large":  {Class: "large", VCPUs: 4, MemoryMib: 2048, DiskMib: 2048},
+}
+
+// ShapeRequest is the requested size of a new machine. Explicit values
+// override the ones of the size class, and the default class is used if
+// nothing is set.
+type ShapeRequest struct {
+	SizeClass string `json:"size_class"`
+	VCPUs     int64  `json:"vcpus"`
+	MemoryMib int64  `json:"memory_mib"`
+	DiskMib   int64  `json:"disk_mib"`
+}
+
+// ResolveShape turns a request into a shape and checks it against the host
+// limits. Errors wrap ErrInvalidShape.
+func ResolveShape(req ShapeRequest, limits config.SizingConfig) (MachineShape, error) {
+	class := req.SizeClass
+	if class == "" {
+		class = limits.DefaultClass
+	}
+	shape, ok := sizeClasses[class]
+	if !ok {
+		return MachineShape{}, fmt.Errorf("%w: unknown size class %q", ErrInvalidShape, class)
+	}
+
+	if req.VCPUs != 0 || req.MemoryMib != 0 || req.DiskMib != 0 {
+		// a customised class is no longer that class
+		shape.Class = ""
+	}
+	if req.VCPUs != 0 {
+		shape.VCPUs = req.VCPUs
+	}
+	if req.MemoryMib != 0 {
+		shape.MemoryMib = req.MemoryMib
+	}
+	if req.DiskMib != 0 {
+		shape.DiskMib = req.DiskMib
+	}
+
+	switch {
+	case shape.VCPUs < 1 || shape.VCPUs > limits.MaxVCPUs:
+		return MachineShape{}, fmt.Errorf("%w: vcpus must be between 1 and %d", ErrInvalidShape, limits.MaxVCPUs)
+	case shape.MemoryMib < minMemoryMib || shape.MemoryMib > limits.MaxMemoryMib:
+		return MachineShape{}, fmt.Errorf("%w: memory must be between %d and %d MiB", ErrInvalidShape, minMemoryMib, limits.MaxMemoryMib)
+	case shape.DiskMib < minDiskMib || shape.DiskMib > limits.MaxDiskMib:
+		return MachineShape{}, fmt.Errorf("%w: disk must be between %d and %d MiB", ErrInvalidShape, minDiskMib, limits.MaxDiskMib)
+	}
+
+	return shape, nil
+}
+
+// DefaultShape is the shape of pooled machines.
+func (manager *VMManager) DefaultShape() MachineShape {
+	return sizeClasses[manager.cfg.Sizing.DefaultClass]
+}
+
+// ResolveShape checks a requested shape against the configured limits.
+func (manager *VMManager) ResolveShape(req ShapeRequest) (MachineShape, error) {
+	return ResolveShape(req, manager.cfg.Sizing)
+}
+
+// sameSize compares the resources of two shapes, ignoring the class name.
+func (s MachineShape) sameSize(other MachineShape) bool {
+	return s.VCPUs == other.VCPUs && s.MemoryMib == other.MemoryMib && s.DiskMib == other.DiskMib
+}
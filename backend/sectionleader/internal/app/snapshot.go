@@ -0,0 +1,392 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
+)
+
+const (
+	snapshotStateName = "vmstate"
+	snapshotMemName   = "memory"
+	snapshotDiskName  = "fs.ext4"
+	snapshotInfoName  = "snapshot.json"
+)
+
+var (
+	ErrSnapshotExists      = errors.New("snapshot already exists")
+	ErrSnapshotNotFound    = errors.New("snapshot does not exist")
+	ErrInvalidSnapshotName = errors.New("snapshot names are lowercase letters, digits, '.', '_' and '-', at most 64 long")
+
+	validSnapshotName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+)
+
+// SnapshotInfo describes a snapshot, it is stored next to the snapshot files.
+type SnapshotInfo struct {
+	Name         string       `json:"name"`
+	CreationTime time.Time    `json:"creation_time"`
+	Shape        MachineShape `json:"shape"`
+	Image        string       `json:"image"`
+}
+
+func snapshotDir(id MachineUUID, name string) string {
+	return filepath.Join(constants.DataDirPath, id.String(), "snapshots", name)
+}
+
+// liveDiskPath is where the VMM of a machine has its root disk open.
+func liveDiskPath(vmPtr *VM) string {
+	if vmPtr.jail != nil {
+		return filepath.Join(jailRootPath(vmPtr.jail.cfg.ChrootBaseDir, "firecracker", vmPtr.Id), snapshotDiskName)
+	}
+	return filepath.Join(constants.DataDirPath, vmPtr.Id.String(), snapshotDiskName)
+}
+
+// CreateSnapshot pauses a running machine, writes its memory, its VM state and
+// a copy of its root disk into a snapshot called name, and resumes it. A
+// machine that was paused already stays paused.
+func (manager *VMManager) CreateSnapshot(id MachineUUID, name string) (SnapshotInfo, error) {
+	if !validSnapshotName.MatchString(name) {
+		return SnapshotInfo{}, ErrInvalidSnapshotName
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), constants.SnapshotTimeout)
+	defer cancelFunc()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		return SnapshotInfo{}, ErrMachineNotFound
+	}
+	if vmPtr.State == StateStopped || vmPtr.Machine == nil {
+		return SnapshotInfo{}, ErrMachineNotRunning
+	}
+
+	return manager.takeSnapshot(ctx, vmPtr, name, true)
+}
+
+// takeSnapshot writes the snapshot called name of a machine with a live VMM,
+// which is paused for it. An active machine is resumed afterwards if resume is
+// set or the snapshot failed. Must be called with manager.mutex held.
+func (manager *VMManager) takeSnapshot(ctx context.Context, vmPtr *VM, name string, resume bool) (SnapshotInfo, error) {
+	id := vmPtr.Id
+	dir := snapshotDir(id, name)
+	if _, err := os.Stat(dir); err == nil {
+		return SnapshotInfo{}, ErrSnapshotExists
+	}
+	err := os.MkdirAll(filepath.Dir(dir), 0755)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	// written next to the final dir and renamed once complete
+	workDir, err := os.MkdirTemp(filepath.Dir(dir), "."+name+"-")
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer os.RemoveAll(workDir)
+
+	wasActive := vmPtr.State == StateActive
+	if wasActive {
+		err = vmPtr.Machine.PauseVM(ctx)
+		if err != nil {
+			return SnapshotInfo{}, fmt.Errorf("pause: %v", err)
+		}
+	}
+
+	start := time.Now()
+	err = manager.writeSnapshot(ctx, vmPtr, workDir)
+
+	if wasActive && (resume || err != nil) {
+		resumeErr := vmPtr.Machine.ResumeVM(ctx)
+		if resumeErr != nil {
+			// the machine is left paused, which its state records
+			vmPtr.State = StatePaused
+			manager.persist(vmPtr)
+			logrus.Errorf("resume machine %s after snapshot: %v", id.String(), resumeErr)
+			if err == nil {
+				err = fmt.Errorf("resume: %v", resumeErr)
+			}
+		}
+	}
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	info := SnapshotInfo{
+		Name:         name,
+		CreationTime: time.Now(),
+		Shape:        vmPtr.data.Shape,
+		Image:        vmPtr.data.Image,
+	}
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	err = os.WriteFile(filepath.Join(workDir, snapshotInfoName), infoBytes, 0644)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	err = os.Rename(workDir, dir)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	logrus.Infof("created snapshot %s of machine %s in %v", name, id.String(), time.Since(start).Round(time.Millisecond))
+	return info, nil
+}
+
+// writeSnapshot writes the snapshot files of a paused VM into dir.
+func (manager *VMManager) writeSnapshot(ctx context.Context, vmPtr *VM, dir string) error {
+	memPath := filepath.Join(dir, snapshotMemName)
+	statePath := filepath.Join(dir, snapshotStateName)
+
+	// a jailed VMM can only write inside its chroot, the files are moved out
+	// afterwards
+	vmmMemPath, vmmStatePath := memPath, statePath
+	if vmPtr.jail != nil {
+		vmmMemPath, vmmStatePath = ".snapshot-"+snapshotMemName, ".snapshot-"+snapshotStateName
+	}
+
+	err := vmPtr.Machine.CreateSnapshot(ctx, vmmMemPath, vmmStatePath)
+	if err != nil {
+		return fmt.Errorf("create snapshot: %v", err)
+	}
+
+	if vmPtr.jail != nil {
+		root := jailRootPath(vmPtr.jail.cfg.ChrootBaseDir, "firecracker", vmPtr.Id)
+		err = moveFile(filepath.Join(root, vmmMemPath), memPath)
+		if err == nil {
+			err = moveFile(filepath.Join(root, vmmStatePath), statePath)
+		}
+		if err != nil {
+			return fmt.Errorf("move snapshot out of jail: %v", err)
+		}
+	}
+
+	// the guest is paused, so the disk matches the memory
+	err = manager.rootfs.clone(liveDiskPath(vmPtr), filepath.Join(dir, snapshotDiskName))
+	if err != nil {
+		return fmt.Errorf("copy root disk: %v", err)
+	}
+	return nil
+}
+
+// RestoreSnapshot replaces the VMM of a machine with one loaded from the
+// snapshot called name. The root disk is reset to the copy in the snapshot,
+// and the network, port forwarding and ingress are set up again with the
+// ports the machine already had.
+func (manager *VMManager) RestoreSnapshot(id MachineUUID, name string) (MachineData, error) {
+	data, err := manager.restoreSnapshot(id, name)
+	if err != nil {
+		return MachineData{}, err
+	}
+	return manager.waitIngress(data.Id)
+}
+
+func (manager *VMManager) restoreSnapshot(id MachineUUID, name string) (MachineData, error) {
+	if !validSnapshotName.MatchString(name) {
+		return MachineData{}, ErrInvalidSnapshotName
+	}
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		return MachineData{}, ErrMachineNotFound
+	}
+
+	return manager.restoreLocked(vmPtr, name)
+}
+
+// restoreLocked is restoreSnapshot, must be called with manager.mutex held. A
+// hibernated machine stays hibernated if the restore fails.
+func (manager *VMManager) restoreLocked(vmPtr *VM, name string) (data MachineData, err error) {
+	id := vmPtr.Id
+	dir := snapshotDir(id, name)
+	infoBytes, err := os.ReadFile(filepath.Join(dir, snapshotInfoName))
+	if os.IsNotExist(err) {
+		return MachineData{}, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return MachineData{}, err
+	}
+	var info SnapshotInfo
+	err = json.Unmarshal(infoBytes, &info)
+	if err != nil {
+		return MachineData{}, fmt.Errorf("snapshot %s: %v", name, err)
+	}
+	img, err := manager.images.Get(info.Image)
+	if err != nil {
+		return MachineData{}, err
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), constants.SnapshotTimeout)
+	defer cancelFunc()
+
+	switch vmPtr.State {
+	case StateHibernated:
+		manager.stopWakeListeners(id)
+		defer func() {
+			if err != nil {
+				manager.startWakeListeners(vmPtr)
+			}
+		}()
+	case StateActive, StatePaused:
+		err = manager.cleanupAllForwarding(vmPtr)
+		if err != nil {
+			logrus.Errorf("failed to cleanup port forwarding for VM %s: %v", id.String(), err)
+		}
+		err = killVMM(ctx, vmPtr)
+		if err != nil {
+			return MachineData{}, fmt.Errorf("stop vmm: %v", err)
+		}
+		vmPtr.State = StateStopped
+		manager.releaseJailSlot(vmPtr.jail)
+		manager.persist(vmPtr)
+	}
+
+	// the new VMM needs its socket path and jail free
+	if vmPtr.jail != nil {
+		err = os.RemoveAll(filepath.Dir(jailRootPath(vmPtr.jail.cfg.ChrootBaseDir, "firecracker", id)))
+		if err != nil {
+			return MachineData{}, fmt.Errorf("remove old jail: %v", err)
+		}
+	} else {
+		removeIfExists(vmPtr.data.SocketPath)
+	}
+	jail, err := manager.takeJailSlot()
+	if err != nil {
+		return MachineData{}, err
+	}
+
+	dataDir := filepath.Join(constants.DataDirPath, id.String())
+	err = manager.rootfs.clone(filepath.Join(dir, snapshotDiskName), filepath.Join(dataDir, snapshotDiskName))
+	if err != nil {
+		manager.releaseJailSlot(jail)
+		return MachineData{}, fmt.Errorf("reset root disk: %v", err)
+	}
+
+	_, subnet, err := net.ParseCIDR(vmPtr.data.Subnet)
+	if err != nil {
+		manager.releaseJailSlot(jail)
+		return MachineData{}, fmt.Errorf("subnet of machine: %v", err)
+	}
+
+	paths := vmFilePaths{
+		id:            id,
+		kernelImgPath: filepath.Join(dataDir, "vmlinux"),
+		fsRootPath:    filepath.Join(dataDir, snapshotDiskName),
+		stdoutPath:    filepath.Join(dataDir, "log", "stdout.log"),
+		stderrPath:    filepath.Join(dataDir, "log", "stderr.log"),
+	}
+	spec := vmSpec{id: id, subnet: subnet, jail: jail, shape: info.Shape, image: img, rootfs: manager.rootfs}
+	opts, err := setVMOpts(paths, spec)
+	if err != nil {
+		manager.releaseJailSlot(jail)
+		return MachineData{}, err
+	}
+	defer opts.Close()
+
+	// lives with the machine, like the context of a spawned VM
+	machineCtx, machineCancel := context.WithCancel(context.Background())
+	machine, err := setupFirecrackerMachine(machineCtx, opts,
+		firecracker.WithSnapshot(filepath.Join(dir, snapshotMemName), filepath.Join(dir, snapshotStateName), func(cfg *firecracker.SnapshotConfig) {
+			cfg.ResumeVM = true
+		}),
+		// WithSnapshot replaces the init handlers, including the ones that
+		// place files in the jail
+		func(m *firecracker.Machine) {
+			if m.Cfg.JailerCfg != nil {
+				m.Cfg.JailerCfg.ChrootStrategy.AdaptHandlers(&m.Handlers)
+			}
+		},
+	)
+	if err == nil {
+		_, err = startMachine(machineCtx, machine)
+	}
+	if err != nil {
+		machineCancel()
+		manager.releaseJailSlot(jail)
+		return MachineData{}, fmt.Errorf("load snapshot: %v", err)
+	}
+
+	pid, err := machine.PID()
+	if err != nil {
+		logrus.Warnf("could not get pid of vm %s: %v", id.String(), err)
+	}
+	vmPtr.Machine = machine
+	vmPtr.cancel = machineCancel
+	vmPtr.jail = jail
+	vmPtr.State = StateActive
+	vmPtr.data.Pid = pid
+	vmPtr.data.SocketPath = machine.Cfg.SocketPath
+	vmPtr.data.Shape = info.Shape
+
+	err = manager.applyForwarding(vmPtr, vmPtr.data.ExposedPorts)
+	if err != nil {
+		logrus.Errorf("failed to setup port forwarding for VM %s: %v", id.String(), err)
+	}
+	err = manager.publish(vmPtr)
+	if err != nil {
+		logrus.Errorf("failed to publish VM %s: %v", id.String(), err)
+	}
+
+	// a hibernated machine that was woken, or restored to another snapshot,
+	// has no use for its hibernation snapshot anymore
+	err = os.RemoveAll(snapshotDir(id, hibernationSnapshot))
+	if err != nil {
+		logrus.Warnf("remove hibernation snapshot of machine %s: %v", id.String(), err)
+	}
+
+	manager.persist(vmPtr)
+	logrus.Infof("restored machine %s from snapshot %s", id.String(), name)
+	return vmPtr.data, nil
+}
+
+// killVMM stops the VMM of a machine without shutting the guest down, it is
+// about to be replaced.
+func killVMM(ctx context.Context, vmPtr *VM) error {
+	if vmPtr.Machine == nil {
+		return nil
+	}
+	if vmPtr.cancel != nil {
+		defer vmPtr.cancel()
+	}
+
+	err := vmPtr.Machine.StopVMM()
+	if err != nil {
+		return err
+	}
+
+	waitCtx, cancelFunc := context.WithTimeout(ctx, constants.DefaultTimeout)
+	defer cancelFunc()
+	vmPtr.Machine.Wait(waitCtx)
+	return nil
+}
+
+// moveFile renames src to dst, copying across filesystems.
+func moveFile(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	err = copyFile(src, dst)
+	if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,53 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// at most this many public keys can be given for one machine
+const maxAuthorizedKeys = 16
+
+var (
+	ErrInvalidSshKey = errors.New("invalid ssh public key")
+	// ErrNoSshKey is returned for machines created with their own public
+	// keys, whose private key never was on the host.
+	ErrNoSshKey = errors.New("machine has no ssh key stored on the server")
+)
+
+// ParseAuthorizedKeys checks public keys given on create and returns them in
+// authorized_keys form, one key per entry. Errors wrap ErrInvalidSshKey.
+func ParseAuthorizedKeys(keys []string) ([]string, error) {
+	if len(keys) > maxAuthorizedKeys {
+		return nil, fmt.Errorf("%w: at most %d keys can be given", ErrInvalidSshKey, maxAuthorizedKeys)
+	}
+
+	parsed := make([]string, 0, len(keys))
+	for i, key := range keys {
+		if strings.ContainsAny(strings.TrimSpace(key), "\r\n") {
+			return nil, fmt.Errorf("%w: key %d spans several lines", ErrInvalidSshKey, i)
+		}
+		pub, comment, options, _, err := ssh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return nil, fmt.Errorf("%w: key %d: %v", ErrInvalidSshKey, i, err)
+		}
+		if len(options) != 0 {
+			return nil, fmt.Errorf("%w: key %d has options", ErrInvalidSshKey, i)
+		}
+
+		line := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(pub)), "\n")
+		if comment != "" {
+			line += " " + comment
+		}
+		parsed = append(parsed, line)
+	}
+	return parsed, nil
+}
+
+// authorizedKeysContent is the authorized_keys file holding keys.
+func authorizedKeysContent(keys []string) []byte {
+	return []byte(strings.Join(keys, "\n") + "\n")
+}
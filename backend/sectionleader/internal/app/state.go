@@ -0,0 +1,33 @@
+package app
+
+import "fmt"
+
+// vmTransitions are the state changes a machine can make. Stopped machines
+// only come back by restoring a snapshot, hibernated ones by being woken.
+var vmTransitions = map[VMState][]VMState{
+	StateActive:     {StatePaused, StateStopped, StateHibernated},
+	StatePaused:     {StateActive, StateStopped},
+	StateStopped:    {StateActive},
+	StateHibernated: {StateActive, StateStopped},
+}
+
+// InvalidTransitionError is returned when a machine is asked to go to a state
+// it can not reach from its current one.
+type InvalidTransitionError struct {
+	From VMState
+	To   VMState
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("machine is %s, it can not become %s", e.From, e.To)
+}
+
+// checkTransition returns an *InvalidTransitionError if from can not become to.
+func checkTransition(from VMState, to VMState) error {
+	for _, allowed := range vmTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+	return &InvalidTransitionError{From: from, To: to}
+}
@@ -0,0 +1,293 @@
+package app
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/store"
+)
+
+// each VM gets a point to point /30: network, host side, guest, broadcast
+const subnetPrefixLen = 30
+
+// SubnetAllocation is a /30 handed out to a machine.
+type SubnetAllocation struct {
+	Subnet      string      `json:"subnet"`
+	MachineId   MachineUUID `json:"machine_id"`
+	MachineName string      `json:"machine_name,omitempty"`
+}
+
+// SubnetUsage is the state of the subnet allocator shown to admins.
+type SubnetUsage struct {
+	Supernet    string             `json:"supernet"`
+	Capacity    int                `json:"capacity"`
+	Used        int                `json:"used"`
+	Allocations []SubnetAllocation `json:"allocations"`
+}
+
+func (manager *VMManager) SubnetUsage() SubnetUsage {
+	allocations := manager.subnets.List()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	for i := range allocations {
+		name, err := manager.IdNameMap.GetName(allocations[i].MachineId)
+		if err == nil {
+			allocations[i].MachineName = name
+		}
+	}
+
+	return SubnetUsage{
+		Supernet:    manager.subnets.Supernet().String(),
+		Capacity:    manager.subnets.Capacity(),
+		Used:        len(allocations),
+		Allocations: allocations,
+	}
+}
+
+// SubnetAllocator hands out /30s from a supernet for the per-VM CNI networks.
+type SubnetAllocator struct {
+	mutex    sync.Mutex
+	supernet *net.IPNet
+	used     map[uint32]MachineUUID
+	store    *store.Store
+}
+
+func NewSubnetAllocator(supernet *net.IPNet, db *store.Store) *SubnetAllocator {
+	return &SubnetAllocator{
+		supernet: supernet,
+		used:     make(map[uint32]MachineUUID),
+		store:    db,
+	}
+}
+
+// Allocate reserves the lowest free /30 for owner. Subnets that still have a
+// host-local IPAM lease on disk are skipped, even if no machine owns them.
+func (a *SubnetAllocator) Allocate(owner MachineUUID) (*net.IPNet, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	leased, err := leasedIps()
+	if err != nil {
+		logrus.Warnf("could not read cni leases, allocating without them: %v", err)
+	}
+
+	first, last := a.bounds()
+	for base := first; base <= last; base += 4 {
+		if _, taken := a.used[base]; taken {
+			continue
+		}
+
+		subnet := subnetFromBase(base)
+		if leasedIn(leased, subnet) {
+			logrus.Warnf("subnet %s has a leftover cni lease, skipping", subnet.String())
+			continue
+		}
+
+		a.used[base] = owner
+		a.persist(base, owner)
+		return subnet, nil
+	}
+
+	return nil, &CapacityError{Resource: "subnets"}
+}
+
+// Reserve marks a subnet as owned, used when loading machines that hold it.
+func (a *SubnetAllocator) Reserve(subnet *net.IPNet, owner MachineUUID) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	base, err := a.baseOf(subnet)
+	if err != nil {
+		return err
+	}
+	a.used[base] = owner
+	a.persist(base, owner)
+	return nil
+}
+
+// Release frees every subnet owned by a machine.
+func (a *SubnetAllocator) Release(owner MachineUUID) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for base, id := range a.used {
+		if id != owner {
+			continue
+		}
+		delete(a.used, base)
+
+		if a.store != nil {
+			err := a.store.Delete(store.BucketSubnets, subnetFromBase(base).String())
+			if err != nil {
+				logrus.Errorf("delete subnet allocation %s: %v", subnetFromBase(base).String(), err)
+			}
+		}
+	}
+}
+
+// ReleaseUnknown frees the subnets of machines known reports as gone, such
+// as pooled VMs of a previous run that never got a record. It returns how
+// many were freed.
+func (a *SubnetAllocator) ReleaseUnknown(known func(MachineUUID) bool) int {
+	a.mutex.Lock()
+	owners := make(map[MachineUUID]bool)
+	for _, id := range a.used {
+		owners[id] = true
+	}
+	a.mutex.Unlock()
+
+	released := 0
+	for id := range owners {
+		if !known(id) {
+			a.Release(id)
+			released++
+		}
+	}
+	return released
+}
+
+// Load restores the allocations recorded in the store.
+func (a *SubnetAllocator) Load() error {
+	if a.store == nil {
+		return nil
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	values, err := a.store.List(store.BucketSubnets)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range values {
+		_, subnet, err := net.ParseCIDR(key)
+		if err != nil {
+			logrus.Errorf("skipping malformed subnet allocation %q", key)
+			continue
+		}
+		base, err := a.baseOf(subnet)
+		if err != nil {
+			logrus.Errorf("skipping subnet allocation %q: %v", key, err)
+			continue
+		}
+
+		var owner MachineUUID
+		err = owner.UnmarshalText(value)
+		if err != nil {
+			logrus.Errorf("skipping subnet allocation %q with malformed owner: %v", key, err)
+			continue
+		}
+		a.used[base] = owner
+	}
+
+	return nil
+}
+
+// List returns the current allocations ordered by subnet.
+func (a *SubnetAllocator) List() []SubnetAllocation {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	bases := make([]uint32, 0, len(a.used))
+	for base := range a.used {
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+
+	allocations := make([]SubnetAllocation, 0, len(bases))
+	for _, base := range bases {
+		allocations = append(allocations, SubnetAllocation{
+			Subnet:    subnetFromBase(base).String(),
+			MachineId: a.used[base],
+		})
+	}
+	return allocations
+}
+
+func (a *SubnetAllocator) Supernet() *net.IPNet {
+	return a.supernet
+}
+
+// Capacity is the number of /30s in the supernet.
+func (a *SubnetAllocator) Capacity() int {
+	first, last := a.bounds()
+	return int((last-first)/4) + 1
+}
+
+func (a *SubnetAllocator) Contains(ip net.IP) bool {
+	return a.supernet.Contains(ip)
+}
+
+// bounds are the first and last /30 handed out. The first /24 of a larger
+// supernet is left alone, in the default 192.168.0.0/16 that is the usual
+// home and office LAN.
+func (a *SubnetAllocator) bounds() (uint32, uint32) {
+	first := binary.BigEndian.Uint32(a.supernet.IP.To4())
+	ones, bits := a.supernet.Mask.Size()
+	size := uint32(1) << uint(bits-ones)
+	last := first + size - 4
+	if ones < 24 {
+		first += 256
+	}
+	return first, last
+}
+
+func (a *SubnetAllocator) baseOf(subnet *net.IPNet) (uint32, error) {
+	ip := subnet.IP.Mask(net.CIDRMask(subnetPrefixLen, 32)).To4()
+	if ip == nil || !a.supernet.Contains(ip) {
+		return 0, fmt.Errorf("subnet %s is outside supernet %s", subnet.String(), a.supernet.String())
+	}
+	return binary.BigEndian.Uint32(ip), nil
+}
+
+func (a *SubnetAllocator) persist(base uint32, owner MachineUUID) {
+	if a.store == nil {
+		return
+	}
+
+	err := a.store.Put(store.BucketSubnets, subnetFromBase(base).String(), []byte(owner.String()))
+	if err != nil {
+		logrus.Errorf("persist subnet allocation %s: %v", subnetFromBase(base).String(), err)
+	}
+}
+
+func subnetFromBase(base uint32) *net.IPNet {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, base)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(subnetPrefixLen, 32)}
+}
+
+// leasedIps returns the addresses host-local IPAM has on disk for the nimbus
+// networks.
+func leasedIps() ([]net.IP, error) {
+	paths, err := filepath.Glob(cniIpamDir + "/fcnet-*/*")
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	for _, path := range paths {
+		ip := net.ParseIP(filepath.Base(path))
+		if ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+func leasedIn(ips []net.IP, subnet *net.IPNet) bool {
+	for _, ip := range ips {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
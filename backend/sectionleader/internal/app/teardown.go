@@ -0,0 +1,155 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
+)
+
+// TeardownStep is the outcome of releasing one resource of a deleted machine.
+type TeardownStep struct {
+	Name  string `json:"name"`
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type TeardownResult struct {
+	MachineId string         `json:"machine_id"`
+	Steps     []TeardownStep `json:"steps"`
+}
+
+func (r *TeardownResult) add(name string, err error) {
+	step := TeardownStep{Name: name, Ok: err == nil}
+	if err != nil {
+		step.Error = err.Error()
+		logrus.Errorf("teardown %s of machine %s failed: %v", name, r.MachineId, err)
+	}
+	r.Steps = append(r.Steps, step)
+}
+
+// Ok reports whether every step succeeded.
+func (r *TeardownResult) Ok() bool {
+	for _, step := range r.Steps {
+		if !step.Ok {
+			return false
+		}
+	}
+	return true
+}
+
+// DeleteVM stops a machine and releases everything it holds: the VMM,
+// port forwarding, what the ingress published, its network, its files and its name.
+// Every step is attempted even if an earlier one fails.
+func (manager *VMManager) DeleteVM(id MachineUUID) (*TeardownResult, error) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), constants.DefaultTimeout*5)
+	defer cancelFunc()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		return nil, ErrMachineNotFound
+	}
+	logrus.Infof("deleting machine %s", id.String())
+
+	result := manager.teardownVM(ctx, vmPtr)
+	logrus.Infof("deleted machine %s, all steps ok: %t", id.String(), result.Ok())
+	return result, nil
+}
+
+// discardVM tears down a VM that was spawned but never handed out.
+func (manager *VMManager) discardVM(vmPtr *VM) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), constants.DefaultTimeout*5)
+	defer cancelFunc()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	result := manager.teardownVM(ctx, vmPtr)
+	logrus.Infof("discarded machine %s, all steps ok: %t", vmPtr.Id.String(), result.Ok())
+}
+
+// teardownVM must be called with manager.mutex held.
+func (manager *VMManager) teardownVM(ctx context.Context, vmPtr *VM) *TeardownResult {
+	id := vmPtr.Id
+	result := &TeardownResult{MachineId: id.String()}
+
+	manager.stopWakeListeners(id)
+	if vmPtr.State != StateStopped {
+		result.add("port_forwarding", manager.cleanupAllForwarding(vmPtr))
+		result.add("vmm", stopVMM(ctx, vmPtr))
+		vmPtr.State = StateStopped
+	}
+
+	result.add("ingress", manager.ingress.Unpublish(id))
+	result.add("cni_config", removeIfExists(CniConfRootDir+"/fcnet-"+id.String()+".conflist"))
+	result.add("cni_lease", os.RemoveAll(filepath.Join(cniIpamDir, "fcnet-"+id.String())))
+	result.add("netns", removeNetNS(id))
+	result.add("data_dir", os.RemoveAll(filepath.Join(constants.DataDirPath, id.String())))
+	if vmPtr.jail != nil {
+		result.add("jail", os.RemoveAll(filepath.Dir(jailRootPath(vmPtr.jail.cfg.ChrootBaseDir, "firecracker", id))))
+		manager.releaseJailSlot(vmPtr.jail)
+	}
+
+	manager.ports.ReleaseAll(id)
+	manager.subnets.Release(id)
+	manager.IdNameMap.remove(id)
+	delete(manager.VMs, id)
+	if manager.store != nil {
+		result.add("record", manager.store.DeleteMachine(id.String()))
+	}
+
+	return result
+}
+
+// stopVMM shuts the guest down, forcing the VMM to stop if it doesn't exit in
+// time.
+func stopVMM(ctx context.Context, vmPtr *VM) error {
+	if vmPtr.Machine == nil {
+		return nil
+	}
+	if vmPtr.cancel != nil {
+		defer vmPtr.cancel()
+	}
+
+	err := vmPtr.Machine.Shutdown(ctx)
+	if err == nil {
+		waitCtx, cancelFunc := context.WithTimeout(ctx, constants.DefaultTimeout)
+		defer cancelFunc()
+		err = vmPtr.Machine.Wait(waitCtx)
+	}
+	if err != nil {
+		logrus.Warnf("machine %s did not shut down cleanly, forcing: %v", vmPtr.Id.String(), err)
+		err = vmPtr.Machine.StopVMM()
+		if err != nil {
+			return fmt.Errorf("force stop: %v", err)
+		}
+	}
+	return nil
+}
+
+func removeNetNS(id MachineUUID) error {
+	if _, err := os.Stat(filepath.Join(netNSDir, id.String())); os.IsNotExist(err) {
+		return nil
+	}
+
+	output, err := exec.Command("ip", "netns", "delete", id.String()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v, output: %s", err, output)
+	}
+	return nil
+}
+
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
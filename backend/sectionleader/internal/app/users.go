@@ -0,0 +1,245 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/config"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/store"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	minPasswordLen = 8
+	// bcrypt ignores everything past 72 bytes
+	maxPasswordLen = 72
+)
+
+var (
+	ErrUserExists         = errors.New("username is taken")
+	ErrUserNotFound       = errors.New("user does not exist")
+	ErrInvalidCredentials = errors.New("wrong username or password")
+	ErrInvalidUsername    = errors.New("usernames are 3 to 32 lowercase letters, digits, '_' and '-'")
+	ErrInvalidPassword    = fmt.Errorf("passwords are %d to %d bytes long", minPasswordLen, maxPasswordLen)
+
+	validUsername = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{2,31}$`)
+)
+
+type UserUUID uuid.UUID
+
+func (o UserUUID) String() string {
+	return uuid.UUID(o).String()
+}
+
+func (o UserUUID) MarshalText() ([]byte, error) {
+	return uuid.UUID(o).MarshalText()
+}
+
+func (o *UserUUID) UnmarshalText(text []byte) error {
+	return (*uuid.UUID)(o).UnmarshalText(text)
+}
+
+// IsZero reports whether o is the owner of machines created without an
+// account.
+func (o UserUUID) IsZero() bool {
+	return o == UserUUID{}
+}
+
+// User is an account that owns machines. Quota replaces the default quota
+// if set. Users signed in elsewhere, through OIDC or a trusted proxy, have
+// External set and no password, and their Name needn't be unique.
+type User struct {
+	Id           UserUUID            `json:"id"`
+	Name         string              `json:"name"`
+	PasswordHash []byte              `json:"password_hash,omitempty"`
+	External     string              `json:"external,omitempty"`
+	CreationTime time.Time           `json:"creation_time"`
+	Quota        *config.QuotaConfig `json:"quota,omitempty"`
+}
+
+// UserRegistry holds the user accounts and writes them to the store.
+type UserRegistry struct {
+	mutex  sync.Mutex
+	byId   map[UserUUID]*User
+	byName map[string]UserUUID
+	// external identities, <provider>|<subject>
+	byExternal map[string]UserUUID
+	store      *store.Store
+	// compared against when the username is unknown, so that a login takes
+	// as long whether or not the user exists
+	dummyHash []byte
+}
+
+func NewUserRegistry(db *store.Store) *UserRegistry {
+	dummyHash, _ := bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+	return &UserRegistry{
+		byId:       make(map[UserUUID]*User),
+		byName:     make(map[string]UserUUID),
+		byExternal: make(map[string]UserUUID),
+		store:      db,
+		dummyHash:  dummyHash,
+	}
+}
+
+// Register creates a user with the given name and password.
+func (r *UserRegistry) Register(name string, password string) (User, error) {
+	if !validUsername.MatchString(name) {
+		return User{}, ErrInvalidUsername
+	}
+	if len(password) < minPasswordLen || len(password) > maxPasswordLen {
+		return User{}, ErrInvalidPassword
+	}
+
+	// hashed before taking the lock, it is slow on purpose
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.byName[name]; ok {
+		return User{}, ErrUserExists
+	}
+
+	user := &User{
+		Id:           UserUUID(uuid.New()),
+		Name:         name,
+		PasswordHash: hash,
+		CreationTime: time.Now(),
+	}
+	err = r.persist(user)
+	if err != nil {
+		return User{}, err
+	}
+	r.byId[user.Id] = user
+	r.byName[name] = user.Id
+
+	logrus.Infof("registered user %s (%s)", user.Id.String(), name)
+	return *user, nil
+}
+
+// Authenticate returns the user if the password is theirs, and
+// ErrInvalidCredentials otherwise.
+func (r *UserRegistry) Authenticate(name string, password string) (User, error) {
+	r.mutex.Lock()
+	var user *User
+	if id, ok := r.byName[name]; ok {
+		user = r.byId[id]
+	}
+	r.mutex.Unlock()
+
+	if user == nil {
+		bcrypt.CompareHashAndPassword(r.dummyHash, []byte(password))
+		return User{}, ErrInvalidCredentials
+	}
+	err := bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(password))
+	if err != nil {
+		return User{}, ErrInvalidCredentials
+	}
+	return *user, nil
+}
+
+// EnsureExternal returns the user with the given external identity, creating
+// them the first time they are seen. name is kept up to date for display.
+func (r *UserRegistry) EnsureExternal(external string, name string) (User, error) {
+	if external == "" {
+		return User{}, fmt.Errorf("empty external identity")
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if id, ok := r.byExternal[external]; ok {
+		user := r.byId[id]
+		if name != "" && user.Name != name {
+			updated := *user
+			updated.Name = name
+			err := r.persist(&updated)
+			if err != nil {
+				return User{}, err
+			}
+			*user = updated
+		}
+		return *user, nil
+	}
+
+	user := &User{
+		Id:           UserUUID(uuid.New()),
+		Name:         name,
+		External:     external,
+		CreationTime: time.Now(),
+	}
+	err := r.persist(user)
+	if err != nil {
+		return User{}, err
+	}
+	r.byId[user.Id] = user
+	r.byExternal[external] = user.Id
+
+	logrus.Infof("registered external user %s (%s)", user.Id.String(), external)
+	return *user, nil
+}
+
+func (r *UserRegistry) Get(id UserUUID) (User, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	user, ok := r.byId[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return *user, nil
+}
+
+// Load restores the users recorded in the store.
+func (r *UserRegistry) Load() error {
+	if r.store == nil {
+		return nil
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	values, err := r.store.List(store.BucketUsers)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range values {
+		var user User
+		err = json.Unmarshal(value, &user)
+		if err != nil {
+			logrus.Errorf("skipping malformed user record %s: %v", key, err)
+			continue
+		}
+		r.byId[user.Id] = &user
+		if user.External != "" {
+			r.byExternal[user.External] = user.Id
+		} else {
+			r.byName[user.Name] = user.Id
+		}
+	}
+
+	return nil
+}
+
+// persist must be called with r.mutex held.
+func (r *UserRegistry) persist(user *User) error {
+	if r.store == nil {
+		return nil
+	}
+
+	value, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+	return r.store.Put(store.BucketUsers, user.Id.String(), value)
+}
@@ -2,15 +2,21 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"sync"
 	"time"
 
 	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/config"
 	"github.com/tongshengw/nimbus/backend/sectionleader/internal/constants"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/images"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/store"
 )
 
 type VMState int
@@ -19,8 +25,23 @@ const (
 	StateActive VMState = iota
 	StatePaused
 	StateStopped
+	StateHibernated
 )
 
+func (s VMState) String() string {
+	switch s {
+	case StateActive:
+		return "active"
+	case StatePaused:
+		return "paused"
+	case StateStopped:
+		return "stopped"
+	case StateHibernated:
+		return "hibernated"
+	}
+	return "unknown"
+}
+
 type MachineData struct {
 	Id             MachineUUID
 	Name           string
@@ -28,7 +49,18 @@ type MachineData struct {
 	RemotePort     int     // SSH remote port (8000-9000 range)
 	LocalPort      int     // Local port for game forwarding (10000-11000 range)
 	GameRemotePort int     // Remote port for game access (12000-13000 range)
+	ExposedPorts   []ExposedPort // every forwarded guest port, including the game port
 	CreationTime   time.Time
+	Subnet         string // /30 of the VM's CNI network
+	Pid            int    // firecracker (or jailer) pid
+	SocketPath     string // firecracker API socket on the host
+	Shape          MachineShape
+	Image          string    // name of the catalog image
+	User           string    // default user of the image
+	AuthorizedKeys []string  // public keys given on create, empty if the server generated the key
+	ExpiresAt      time.Time // end of the lease, zero if it never expires
+	Owner          UserUUID  // zero for machines created without an account
+	Conditions     []MachineCondition
 }
 
 type VM struct {
@@ -37,6 +69,7 @@ type VM struct {
 	State   VMState
 	cancel  context.CancelFunc
 	data    MachineData
+	jail    *jailSpec
 }
 
 type VMManager struct {
@@ -44,121 +77,321 @@ type VMManager struct {
 	createVmMutex sync.Mutex
 	IdNameMap     *IdNameMap
 	VMs           map[MachineUUID]*VM
+	Users         *UserRegistry
+	Revocations   *RevocationList
+	AdminKeys     *AdminKeyRegistry
+
+	cfg       config.Config
+	store     *store.Store
+	pool      *vmPool
+	jailSlots map[int]bool
+	ports     *PortAllocator
+	subnets   *SubnetAllocator
+	forwarder Forwarder
+	ingress   IngressProvider
+	images    *images.Catalog
+	rootfs    *rootfsProvisioner
+
+	// listeners on the forwarded ports of hibernated machines
+	wakers map[MachineUUID][]io.Closer
+
+	// machines being created, counted against the quota of their owner
+	pendingUsage map[UserUUID]Usage
+}
+
+// CreateVMResult is sent once by CreateVM, Data is nil if Err is set.
+type CreateVMResult struct {
+	Data *MachineData
+	Err  error
 }
 
-func NewVMManager() *VMManager {
+func NewVMManager(cfg config.Config, db *store.Store) (*VMManager, error) {
+	_, err := ResolveShape(ShapeRequest{}, cfg.Sizing)
+	if err != nil {
+		return nil, fmt.Errorf("default size class: %v", err)
+	}
+	for class := range cfg.Lease.MaxByClass {
+		if _, ok := sizeClasses[class]; !ok {
+			return nil, fmt.Errorf("lease limit of unknown size class %q", class)
+		}
+	}
+
+	catalog, err := images.Load(cfg.ImagesDir)
+	if err != nil {
+		return nil, fmt.Errorf("image catalog: %v", err)
+	}
+	_, err = catalog.Get(cfg.DefaultImage)
+	if errors.Is(err, images.ErrImageNotFound) {
+		_, legacyErr := catalog.AddLegacy(cfg.DefaultImage, legacyRefDir)
+		if legacyErr != nil {
+			return nil, fmt.Errorf("default image: %v in %s, and no legacy image: %v", err, cfg.ImagesDir, legacyErr)
+		}
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("default image: %v", err)
+	}
+
+	rootfs, err := newRootfsProvisioner(cfg.RootfsCacheDir, cfg.RootfsClone)
+	if err != nil {
+		return nil, fmt.Errorf("root disk cache: %v", err)
+	}
+
+	forwarder, err := NewForwarder(cfg.Forwarder)
+	if err != nil {
+		return nil, err
+	}
+	ingress, err := NewIngressProvider(cfg.Ingress)
+	if err != nil {
+		return nil, err
+	}
+
 	return &VMManager{
 		mutex:         sync.Mutex{},
 		createVmMutex: sync.Mutex{},
 		IdNameMap:     NewIdNameMap(),
 		VMs:           make(map[MachineUUID]*VM),
-	}
+		Users:         NewUserRegistry(db),
+		Revocations:   NewRevocationList(db),
+		AdminKeys:     NewAdminKeyRegistry(db, cfg.AdminApiKey),
+		cfg:           cfg,
+		store:         db,
+		pool:          newVMPool(cfg.PoolSize),
+		jailSlots:     make(map[int]bool),
+		ports:         NewPortAllocator(db),
+		subnets:       NewSubnetAllocator(cfg.CniSupernet, db),
+		forwarder:     forwarder,
+		ingress:       ingress,
+		images:        catalog,
+		rootfs:        rootfs,
+		wakers:        make(map[MachineUUID][]io.Closer),
+		pendingUsage:  make(map[UserUUID]Usage),
+	}, nil
 }
 
-func (manager *VMManager) CreateVM() (<-chan *MachineData, error) {
-	// has to be withcancel as this is the context that lives with the machine
-	ctx, cancelFunc := context.WithCancel(context.Background())
-	outputChannel := make(chan *MachineData)
+// CreateVM boots a machine of the given shape and image, which must come from
+// ResolveShape and ResolveImage. keys come from ParseAuthorizedKeys, if any
+// are given no private key is generated. Pooled machines are only used for
+// the default shape and image without keys. The lease, from ResolveLease,
+// starts once the machine is handed out. A machine with an owner has to fit in
+// their quota, which is checked before anything is allocated.
+func (manager *VMManager) CreateVM(owner UserUUID, shape MachineShape, img images.Image, keys []string, lease time.Duration) (<-chan CreateVMResult, error) {
+	releaseQuota := func() {}
+	if !owner.IsZero() {
+		var err error
+		releaseQuota, err = manager.reserveQuota(owner, shape, lease)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// buffered so the VM is not leaked if the caller stopped waiting
+	outputChannel := make(chan CreateVMResult, 1)
 
 	go func() {
-		manager.createVmMutex.Lock()
-		defer manager.createVmMutex.Unlock()
+		defer releaseQuota()
 
-		machine, id, ip, err := SpawnNewVM(ctx)
-		if err != nil {
-			logrus.Errorf("failed to spawn VM: %v", err)
-			outputChannel <- nil
-			return
+		var vmPtr *VM
+		if shape.sameSize(manager.DefaultShape()) && img.Name == manager.cfg.DefaultImage && len(keys) == 0 {
+			vmPtr = manager.pool.claim()
 		}
-
-		if machine == nil {
-			logrus.Errorf("spawnvm return error")
-			outputChannel <- nil
-			return
+		if vmPtr != nil {
+			logrus.Infof("claimed pooled vm %s", vmPtr.Id.String())
+			vmPtr.data.Shape = shape
+		} else {
+			var err error
+			vmPtr, err = manager.spawnVM(shape, img, keys)
+			if err != nil {
+				logrus.Errorf("failed to spawn VM: %v", err)
+				outputChannel <- CreateVMResult{Err: err}
+				return
+			}
 		}
+		manager.pool.requestRefill()
 
-		manager.mutex.Lock()
-		defer manager.mutex.Unlock()
-
-		vmName, err := manager.IdNameMap.GenerateNewName(id)
+		// pooled VMs were booted long before they were asked for
+		vmPtr.data.CreationTime = time.Now()
+		vmPtr.data.ExpiresAt = leaseExpiry(lease)
+		vmPtr.data.Owner = owner
+		_, err := manager.activateVM(vmPtr)
 		if err != nil {
-			logrus.Errorf("could not generate name for new vm: %v", err)
+			logrus.Errorf("failed to activate VM %s: %v", vmPtr.Id.String(), err)
+			manager.discardVM(vmPtr)
+			outputChannel <- CreateVMResult{Err: err}
 			return
 		}
 
-		vmPtr := &VM{
-			Machine: machine,
-			Id:      id,
-			State:   StateActive,
-			cancel:  cancelFunc,
-			data: MachineData{
-				Id:             id,
-				Name:           vmName,
-				LocalIp:        ip,
-				CreationTime:   time.Now(),
-				RemotePort:     constants.MinRemotePort + len(manager.VMs),
-				LocalPort:      constants.MinLocalForwardPort + len(manager.VMs),
-				GameRemotePort: constants.MinGameRemotePort + len(manager.VMs),
-			}}
-
-		// Set up iptables port forwarding for the game port
-		err = SetupPortForwarding(ip.IP, vmPtr.data.LocalPort)
+		// a machine whose proxies did not come up is still handed out, the
+		// failure is reported in its conditions
+		data, err := manager.waitIngress(vmPtr.Id)
 		if err != nil {
-			logrus.Errorf("failed to setup port forwarding for VM %s: %v", id.String(), err)
-			// Continue anyway - VM is created, just port forwarding failed
+			logrus.Errorf("vm %s went away before it was handed out: %v", vmPtr.Id.String(), err)
+			outputChannel <- CreateVMResult{Err: err}
+			return
 		}
-
-		manager.VMs[id] = vmPtr
-		outputChannel <- &vmPtr.data
+		outputChannel <- CreateVMResult{Data: &data}
 	}()
 
 	return outputChannel, nil
 }
 
-func (manager *VMManager) PauseVM(id MachineUUID) {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*5)
+// spawnVM boots a new firecracker machine that is not yet visible to users.
+func (manager *VMManager) spawnVM(shape MachineShape, img images.Image, keys []string) (*VM, error) {
+	manager.createVmMutex.Lock()
+	defer manager.createVmMutex.Unlock()
 
-	go func(ctx context.Context, cancelFunc context.CancelFunc, manager *VMManager, id MachineUUID) {
-		defer cancelFunc()
+	err := manager.images.Verify(img)
+	if err != nil {
+		return nil, err
+	}
+
+	id := MachineUUID(uuid.New())
+	subnet, err := manager.subnets.Allocate(id)
+	if err != nil {
+		return nil, err
+	}
+
+	jail, err := manager.allocJailSlot()
+	if err != nil {
+		manager.subnets.Release(id)
+		return nil, err
+	}
+
+	// has to be withcancel as this is the context that lives with the machine
+	ctx, cancelFunc := context.WithCancel(context.Background())
 
+	spec := vmSpec{id: id, subnet: subnet, jail: jail, shape: shape, image: img, rootfs: manager.rootfs, authorizedKeys: keys}
+	machine, ip, err := SpawnNewVM(ctx, spec)
+	if err == nil && machine == nil {
+		err = fmt.Errorf("spawnvm returned nil machine")
+	}
+	if err != nil {
+		cancelFunc()
+		manager.subnets.Release(id)
 		manager.mutex.Lock()
-		defer manager.mutex.Unlock()
+		manager.releaseJailSlot(jail)
+		manager.mutex.Unlock()
+		return nil, err
+	}
 
-		vmPtr := manager.VMs[id]
-		if vmPtr.State != StateActive {
-			logrus.Errorf("machine not active, cannot be paused, id: %s", id.String())
-			return
-		}
+	pid, err := machine.PID()
+	if err != nil {
+		logrus.Warnf("could not get pid of vm %s: %v", id.String(), err)
+	}
 
-		err := vmPtr.Machine.PauseVM(ctx)
-		if err != nil {
-			logrus.Errorf("pause vm error")
-			return
-		}
+	return &VM{
+		Machine: machine,
+		Id:      id,
+		State:   StateActive,
+		cancel:  cancelFunc,
+		jail:    jail,
+		data: MachineData{
+			Id:             id,
+			LocalIp:        ip,
+			CreationTime:   time.Now(),
+			Subnet:         subnet.String(),
+			Pid:            pid,
+			SocketPath:     machine.Cfg.SocketPath,
+			Shape:          shape,
+			Image:          img.Name,
+			User:           img.DefaultUser,
+			AuthorizedKeys: keys,
+		}}, nil
+}
+
+// activateVM names a booted VM, assigns its ports and registers it with the
+// manager so it can be handed out.
+func (manager *VMManager) activateVM(vmPtr *VM) (*MachineData, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
 
-		vmPtr.State = StatePaused
-	}(ctx, cancelFunc, manager, id)
+	id := vmPtr.Id
+	var err error
+	vmPtr.data.RemotePort, err = manager.ports.Allocate(PortPoolSsh, ProtocolTCP, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// Set up iptables port forwarding for the game port
+	_, err = manager.exposePort(vmPtr, ProtocolTCP, constants.InternalGamePort)
+	var capacityErr *CapacityError
+	if errors.As(err, &capacityErr) {
+		manager.ports.ReleaseAll(id)
+		vmPtr.data.RemotePort = 0
+		return nil, err
+	}
+	if err != nil {
+		logrus.Errorf("failed to setup port forwarding for VM %s: %v", id.String(), err)
+		// Continue anyway - VM is created, just port forwarding failed
+	}
+
+	vmName, err := manager.IdNameMap.GenerateNewName(id)
+	if err != nil {
+		manager.ports.ReleaseAll(id)
+		return nil, fmt.Errorf("could not generate name for new vm: %v", err)
+	}
+	vmPtr.data.Name = vmName
+
+	err = manager.publish(vmPtr)
+	if err != nil {
+		manager.IdNameMap.remove(id)
+		manager.ports.ReleaseAll(id)
+		return nil, err
+	}
+
+	manager.VMs[id] = vmPtr
+	manager.persist(vmPtr)
+	return &vmPtr.data, nil
 }
 
-func (manager *VMManager) ResumeVM(id MachineUUID) {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*5)
+// PauseVM pauses the vCPUs of a running machine and returns its new state.
+func (manager *VMManager) PauseVM(id MachineUUID) (VMState, error) {
+	return manager.setPaused(id, true)
+}
 
-	go func(ctx context.Context, cancelFunc context.CancelFunc, manager *VMManager, id MachineUUID) {
-		defer cancelFunc()
+// ResumeVM resumes a paused machine and returns its new state.
+func (manager *VMManager) ResumeVM(id MachineUUID) (VMState, error) {
+	return manager.setPaused(id, false)
+}
 
-		vmPtr := manager.VMs[id]
-		if vmPtr.State != StatePaused {
-			logrus.Errorf("machine not paused, cannot be resumed, id %s", id.String())
-			return
-		}
-		err := vmPtr.Machine.PauseVM(ctx)
-		if err != nil {
-			logrus.Errorf("resume vm error")
-			return
-		}
+func (manager *VMManager) setPaused(id MachineUUID, paused bool) (VMState, error) {
+	ctx, cancelFunc := context.WithTimeout(context.Background(), constants.DefaultTimeout)
+	defer cancelFunc()
+
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		return 0, ErrMachineNotFound
+	}
 
-		vmPtr.State = StateActive
-	}(ctx, cancelFunc, manager, id)
+	if vmPtr.State == StateHibernated {
+		return vmPtr.State, ErrMachineHibernated
+	}
+
+	target, action := StateActive, "resume"
+	if paused {
+		target, action = StatePaused, "pause"
+	}
+	err := checkTransition(vmPtr.State, target)
+	if err != nil {
+		return vmPtr.State, err
+	}
+
+	if paused {
+		err = vmPtr.Machine.PauseVM(ctx)
+	} else {
+		err = vmPtr.Machine.ResumeVM(ctx)
+	}
+	if err != nil {
+		return vmPtr.State, fmt.Errorf("%s machine %s: %v", action, id.String(), err)
+	}
+
+	vmPtr.State = target
+	manager.persist(vmPtr)
+	logrus.Infof("machine %s is %s", id.String(), target)
+	return target, nil
 }
 
 func (manager *VMManager) GracefulShutdownVM(id MachineUUID) <-chan bool {
@@ -173,20 +406,34 @@ func (manager *VMManager) GracefulShutdownVM(id MachineUUID) <-chan bool {
 		manager.mutex.Lock()
 		defer manager.mutex.Unlock()
 
-		vmPtr := manager.VMs[id]
+		vmPtr, ok := manager.VMs[id]
+		if !ok {
+			logrus.Errorf("attempted to shutdown unknown machine, id: %s", id.String())
+			return
+		}
 
-		if vmPtr.State == StateStopped {
-			logrus.Errorf("attempted to shutdown stopped machine, id: %s", id.String())
+		// a hibernated machine has no VMM, it stays on disk and gets its
+		// wake listeners back on the next start
+		if vmPtr.State == StateHibernated {
+			manager.stopWakeListeners(id)
+			outputChan <- true
+			return
+		}
+
+		if err := checkTransition(vmPtr.State, StateStopped); err != nil {
+			logrus.Errorf("attempted to shutdown machine %s: %v", id.String(), err)
 			return
 		}
 
 		// Clean up port forwarding rules before shutting down VM
-		err := CleanupPortForwarding(vmPtr.data.LocalIp.IP, vmPtr.data.LocalPort)
+		err := manager.cleanupAllForwarding(vmPtr)
 		if err != nil {
 			logrus.Errorf("failed to cleanup port forwarding for VM %s: %v", id.String(), err)
 		}
 
 		vmPtr.State = StateStopped
+		manager.releaseJailSlot(vmPtr.jail)
+		manager.persist(vmPtr)
 		err = vmPtr.Machine.Shutdown(ctx)
 		if err != nil {
 			logrus.Errorf("machine shutdown err, id: %s, err %v, forcing shutdown", id.String(), err)
@@ -205,6 +452,8 @@ func (manager *VMManager) GracefulShutdownVM(id MachineUUID) <-chan bool {
 	return outputChan
 }
 
+// GracefulShutdownAll stops every machine. The pool is left running, the
+// server drains it itself when it exits.
 func (manager *VMManager) GracefulShutdownAll() error {
 	shutdownChans := make([]<-chan bool, len(manager.VMs))
 
@@ -227,12 +476,26 @@ func (manager *VMManager) GracefulShutdownAll() error {
 	return nil
 }
 
+// GetSshKey returns the private key the server generated for a machine, or
+// ErrNoSshKey if the machine was created with its own public keys.
 func (manager *VMManager) GetSshKey(id MachineUUID) ([]byte, error) {
-	if _, ok := manager.VMs[id]; !ok {
-		return nil, fmt.Errorf("machine does not exist")
+	manager.mutex.Lock()
+	vmPtr, ok := manager.VMs[id]
+	if !ok {
+		manager.mutex.Unlock()
+		return nil, ErrMachineNotFound
+	}
+	ownKeys := len(vmPtr.data.AuthorizedKeys) != 0
+	manager.mutex.Unlock()
+	if ownKeys {
+		return nil, ErrNoSshKey
 	}
 
-	key, err := os.ReadFile(constants.DataDirPath + "/" + id.String() + "/id_rsa")
+	dir := constants.DataDirPath + "/" + id.String()
+	key, err := os.ReadFile(dir + "/" + sshKeyName)
+	if os.IsNotExist(err) {
+		key, err = os.ReadFile(dir + "/" + legacySshKeyName)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,566 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the sectionleader settings that are read from the environment
+// (and .env) at startup.
+type Config struct {
+	SecretKey string
+
+	// admin API key that always works, to create the first stored keys with;
+	// empty for none
+	AdminApiKey string
+
+	Tokens TokenConfig
+
+	// path of the embedded database holding machine state
+	DbPath string
+
+	// number of pre-booted VMs kept ready to be claimed by new-machine
+	PoolSize int
+
+	// every VM gets a /30 out of this range for its CNI network
+	CniSupernet *net.IPNet
+
+	// port forwarding backend, iptables or nftables
+	Forwarder string
+
+	Ingress IngressConfig
+
+	Sizing SizingConfig
+
+	// directory of the image catalog, and the image used when none is
+	// requested and for pooled machines
+	ImagesDir    string
+	DefaultImage string
+
+	// where the ext4 root disk of every image is built, and how VMs get a
+	// copy of it: auto, reflink or sparse
+	RootfsCacheDir string
+	RootfsClone    string
+
+	Jailer JailerConfig
+
+	Idle IdleConfig
+
+	Lease LeaseConfig
+
+	Users UsersConfig
+
+	Auth AuthConfig
+}
+
+// SizingConfig limits the machine shapes that can be requested, and picks the
+// size class used when none is requested.
+type SizingConfig struct {
+	DefaultClass string
+	MaxVCPUs     int64
+	MaxMemoryMib int64
+	MaxDiskMib   int64
+}
+
+// IngressConfig selects how machines are reached from outside the host: frpc,
+// direct (ports published on the host) or local (nothing published).
+type IngressConfig struct {
+	Provider string
+
+	// address returned to clients for every public port
+	PublicAddress string
+
+	// directory included by the frpc config, and the frpc admin api (its
+	// webServer) used to reload it and check on the proxies
+	FrpcConfigDir     string
+	FrpcAdminAddr     string
+	FrpcAdminUser     string
+	FrpcAdminPassword string
+}
+
+// IdleConfig controls hibernation of idle machines. Machines without network
+// traffic for Timeout are snapshotted to disk and stopped, a zero Timeout
+// turns this off.
+type IdleConfig struct {
+	Timeout       time.Duration
+	CheckInterval time.Duration
+}
+
+// LeaseConfig limits how long machines live before the reaper deletes them.
+// Machines that don't ask for a lease get Default, capped at the max. A zero
+// Max, for all machines or for a size class in MaxByClass, puts no limit on
+// the lease, and a zero lease never expires.
+type LeaseConfig struct {
+	Default      time.Duration
+	Max          time.Duration
+	MaxByClass   map[string]time.Duration
+	ReapInterval time.Duration
+}
+
+// TokenConfig is how long the tokens signed with the secret key last. A
+// machine token is refreshed with its refresh token, a user logs in again.
+type TokenConfig struct {
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	UserTTL    time.Duration
+}
+
+// UsersConfig controls who can create machines. Without AllowAnonymous only
+// logged in users can, and each of them gets Quota unless their account has
+// its own.
+type UsersConfig struct {
+	AllowAnonymous bool
+	Quota          QuotaConfig
+}
+
+// AuthConfig picks how users are authenticated, in order: "jwt" for the
+// tokens from login, "oidc" for bearer tokens of an OpenID Connect issuer and
+// "header" for a user name set by a trusted proxy in front of the server.
+type AuthConfig struct {
+	Methods       []string
+	OIDC          OIDCConfig
+	TrustedHeader TrustedHeaderConfig
+}
+
+// OIDCConfig is the issuer whose tokens are accepted. The signing keys are
+// read from JwksUrl, or from the issuer's discovery document if it is empty.
+type OIDCConfig struct {
+	Issuer        string
+	Audience      string
+	JwksUrl       string
+	UsernameClaim string
+}
+
+// TrustedHeaderConfig is the header holding the user name, which is only
+// believed from the proxies in TrustedProxies.
+type TrustedHeaderConfig struct {
+	Header         string
+	TrustedProxies []*net.IPNet
+}
+
+// QuotaConfig is the most a user's machines may hold at once, and the longest
+// lease they may have. A zero limit is no limit.
+type QuotaConfig struct {
+	MaxMachines  int           `json:"max_machines"`
+	MaxVCPUs     int64         `json:"max_vcpus"`
+	MaxMemoryMib int64         `json:"max_memory_mib"`
+	MaxLease     time.Duration `json:"max_lease"`
+}
+
+// JailerConfig controls whether VMs are launched under the firecracker jailer.
+// Every jailed VM gets its own uid and gid, UidBase+slot and GidBase+slot.
+type JailerConfig struct {
+	Enabled       bool
+	Binary        string
+	ChrootBaseDir string
+	UidBase       int
+	GidBase       int
+	MaxJails      int
+	NumaNode      int
+	CgroupVersion string
+	ParentCgroup  string
+}
+
+func Load() (Config, error) {
+	var cfg Config
+	var err error
+
+	cfg.SecretKey = os.Getenv("SECRET_KEY")
+	if cfg.SecretKey == "" {
+		return Config{}, fmt.Errorf("SECRET_KEY must be set")
+	}
+
+	cfg.AdminApiKey = os.Getenv("ADMIN_API_KEY")
+	if cfg.AdminApiKey != "" && cfg.AdminApiKey == cfg.SecretKey {
+		return Config{}, fmt.Errorf("ADMIN_API_KEY must not be SECRET_KEY")
+	}
+
+	cfg.Tokens, err = loadTokenConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg.DbPath = getEnvString("DB_PATH", "./nimbus.db")
+
+	cfg.CniSupernet, err = parseSupernet(getEnvString("CNI_SUPERNET", "192.168.0.0/16"))
+	if err != nil {
+		return Config{}, fmt.Errorf("CNI_SUPERNET: %v", err)
+	}
+
+	cfg.Forwarder = getEnvString("FORWARDER", "iptables")
+	if cfg.Forwarder != "iptables" && cfg.Forwarder != "nftables" {
+		return Config{}, fmt.Errorf("FORWARDER must be iptables or nftables")
+	}
+
+	cfg.Ingress, err = loadIngressConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg.ImagesDir = getEnvString("IMAGES_DIR", "./_images")
+	cfg.DefaultImage = getEnvString("DEFAULT_IMAGE", "default")
+
+	cfg.RootfsCacheDir = getEnvString("ROOTFS_CACHE_DIR", "./_rootfs")
+	cfg.RootfsClone = getEnvString("ROOTFS_CLONE", "auto")
+	switch cfg.RootfsClone {
+	case "auto", "reflink", "sparse":
+	default:
+		return Config{}, fmt.Errorf("ROOTFS_CLONE must be auto, reflink or sparse")
+	}
+
+	cfg.Sizing, err = loadSizingConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg.PoolSize, err = getEnvInt("POOL_SIZE", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	if cfg.PoolSize < 0 {
+		return Config{}, fmt.Errorf("POOL_SIZE must not be negative")
+	}
+
+	cfg.Jailer, err = loadJailerConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg.Idle.Timeout, err = getEnvDuration("IDLE_TIMEOUT", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.Idle.CheckInterval, err = getEnvDuration("IDLE_CHECK_INTERVAL", time.Minute)
+	if err != nil {
+		return Config{}, err
+	}
+	if cfg.Idle.Timeout < 0 || cfg.Idle.CheckInterval <= 0 {
+		return Config{}, fmt.Errorf("IDLE_TIMEOUT must not be negative and IDLE_CHECK_INTERVAL must be positive")
+	}
+
+	cfg.Lease, err = loadLeaseConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg.Users, err = loadUsersConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	cfg.Auth, err = loadAuthConfig()
+	if err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+func loadJailerConfig() (JailerConfig, error) {
+	var err error
+	jailer := JailerConfig{
+		Binary:        getEnvString("JAILER_BINARY", "../../firecracker/release/jailer"),
+		ChrootBaseDir: getEnvString("JAILER_CHROOT_BASE_DIR", "/srv/jailer"),
+		CgroupVersion: getEnvString("JAILER_CGROUP_VERSION", "2"),
+		ParentCgroup:  getEnvString("JAILER_PARENT_CGROUP", "nimbus"),
+	}
+
+	jailer.Enabled, err = getEnvBool("JAILER_ENABLED", false)
+	if err != nil {
+		return JailerConfig{}, err
+	}
+	jailer.UidBase, err = getEnvInt("JAILER_UID_BASE", 100000)
+	if err != nil {
+		return JailerConfig{}, err
+	}
+	jailer.GidBase, err = getEnvInt("JAILER_GID_BASE", 100000)
+	if err != nil {
+		return JailerConfig{}, err
+	}
+	jailer.MaxJails, err = getEnvInt("JAILER_MAX_JAILS", 1000)
+	if err != nil {
+		return JailerConfig{}, err
+	}
+	jailer.NumaNode, err = getEnvInt("JAILER_NUMA_NODE", 0)
+	if err != nil {
+		return JailerConfig{}, err
+	}
+
+	if jailer.Enabled {
+		if jailer.UidBase <= 0 || jailer.GidBase <= 0 {
+			return JailerConfig{}, fmt.Errorf("JAILER_UID_BASE and JAILER_GID_BASE must be positive")
+		}
+		if jailer.MaxJails <= 0 {
+			return JailerConfig{}, fmt.Errorf("JAILER_MAX_JAILS must be positive")
+		}
+		if jailer.CgroupVersion != "1" && jailer.CgroupVersion != "2" {
+			return JailerConfig{}, fmt.Errorf("JAILER_CGROUP_VERSION must be 1 or 2")
+		}
+	}
+
+	return jailer, nil
+}
+
+func loadLeaseConfig() (LeaseConfig, error) {
+	var lease LeaseConfig
+	var err error
+
+	lease.Default, err = getEnvDuration("LEASE_DEFAULT", 24*time.Hour)
+	if err != nil {
+		return LeaseConfig{}, err
+	}
+	lease.Max, err = getEnvDuration("LEASE_MAX", 7*24*time.Hour)
+	if err != nil {
+		return LeaseConfig{}, err
+	}
+	lease.ReapInterval, err = getEnvDuration("LEASE_REAP_INTERVAL", time.Minute)
+	if err != nil {
+		return LeaseConfig{}, err
+	}
+	if lease.Default < 0 || lease.Max < 0 || lease.ReapInterval <= 0 {
+		return LeaseConfig{}, fmt.Errorf("LEASE_DEFAULT and LEASE_MAX must not be negative and LEASE_REAP_INTERVAL must be positive")
+	}
+
+	// small=168h,large=24h
+	lease.MaxByClass = make(map[string]time.Duration)
+	for _, entry := range strings.Split(os.Getenv("LEASE_MAX_BY_CLASS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		class, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return LeaseConfig{}, fmt.Errorf("LEASE_MAX_BY_CLASS entry %q is not class=duration", entry)
+		}
+		limit, err := time.ParseDuration(value)
+		if err != nil || limit < 0 {
+			return LeaseConfig{}, fmt.Errorf("LEASE_MAX_BY_CLASS entry %q is not class=duration", entry)
+		}
+		lease.MaxByClass[strings.TrimSpace(class)] = limit
+	}
+
+	return lease, nil
+}
+
+func loadAuthConfig() (AuthConfig, error) {
+	var auth AuthConfig
+
+	for _, method := range strings.Split(getEnvString("AUTH_METHODS", "jwt"), ",") {
+		method = strings.TrimSpace(method)
+		switch method {
+		case "":
+			continue
+		case "jwt", "oidc", "header":
+			auth.Methods = append(auth.Methods, method)
+		default:
+			return AuthConfig{}, fmt.Errorf("AUTH_METHODS entry %q is not jwt, oidc or header", method)
+		}
+	}
+
+	auth.OIDC = OIDCConfig{
+		Issuer:        strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/"),
+		Audience:      os.Getenv("OIDC_AUDIENCE"),
+		JwksUrl:       os.Getenv("OIDC_JWKS_URL"),
+		UsernameClaim: getEnvString("OIDC_USERNAME_CLAIM", "preferred_username"),
+	}
+	if slices.Contains(auth.Methods, "oidc") && (auth.OIDC.Issuer == "" || auth.OIDC.Audience == "") {
+		return AuthConfig{}, fmt.Errorf("OIDC_ISSUER and OIDC_AUDIENCE must be set for oidc auth")
+	}
+
+	auth.TrustedHeader.Header = getEnvString("TRUSTED_HEADER", "X-Forwarded-User")
+	for _, cidr := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return AuthConfig{}, fmt.Errorf("TRUSTED_PROXIES: %v", err)
+		}
+		auth.TrustedHeader.TrustedProxies = append(auth.TrustedHeader.TrustedProxies, ipNet)
+	}
+	if slices.Contains(auth.Methods, "header") && len(auth.TrustedHeader.TrustedProxies) == 0 {
+		return AuthConfig{}, fmt.Errorf("TRUSTED_PROXIES must be set for header auth")
+	}
+
+	return auth, nil
+}
+
+func loadTokenConfig() (TokenConfig, error) {
+	var tokens TokenConfig
+	var err error
+
+	tokens.AccessTTL, err = getEnvDuration("TOKEN_TTL", time.Hour)
+	if err != nil {
+		return TokenConfig{}, err
+	}
+	tokens.RefreshTTL, err = getEnvDuration("REFRESH_TOKEN_TTL", 30*24*time.Hour)
+	if err != nil {
+		return TokenConfig{}, err
+	}
+	tokens.UserTTL, err = getEnvDuration("USER_TOKEN_TTL", 24*time.Hour)
+	if err != nil {
+		return TokenConfig{}, err
+	}
+	if tokens.AccessTTL <= 0 || tokens.RefreshTTL <= 0 || tokens.UserTTL <= 0 {
+		return TokenConfig{}, fmt.Errorf("TOKEN_TTL, REFRESH_TOKEN_TTL and USER_TOKEN_TTL must be positive")
+	}
+
+	return tokens, nil
+}
+
+func loadUsersConfig() (UsersConfig, error) {
+	var users UsersConfig
+	var err error
+
+	// on by default as the nexus frontend creates machines without logging
+	// in; anonymous machines count against no quota, so turn it off where the
+	// server is reachable from untrusted networks
+	users.AllowAnonymous, err = getEnvBool("ALLOW_ANONYMOUS", true)
+	if err != nil {
+		return UsersConfig{}, err
+	}
+
+	users.Quota.MaxMachines, err = getEnvInt("QUOTA_MAX_MACHINES", 3)
+	if err != nil {
+		return UsersConfig{}, err
+	}
+	maxVCPUs, err := getEnvInt("QUOTA_MAX_VCPUS", 4)
+	if err != nil {
+		return UsersConfig{}, err
+	}
+	maxMemoryMib, err := getEnvInt("QUOTA_MAX_MEMORY_MIB", 4096)
+	if err != nil {
+		return UsersConfig{}, err
+	}
+	users.Quota.MaxVCPUs = int64(maxVCPUs)
+	users.Quota.MaxMemoryMib = int64(maxMemoryMib)
+	users.Quota.MaxLease, err = getEnvDuration("QUOTA_MAX_LEASE", 0)
+	if err != nil {
+		return UsersConfig{}, err
+	}
+
+	if users.Quota.MaxMachines < 0 || users.Quota.MaxVCPUs < 0 || users.Quota.MaxMemoryMib < 0 || users.Quota.MaxLease < 0 {
+		return UsersConfig{}, fmt.Errorf("QUOTA_* limits must not be negative")
+	}
+
+	return users, nil
+}
+
+func loadSizingConfig() (SizingConfig, error) {
+	sizing := SizingConfig{
+		DefaultClass: getEnvString("DEFAULT_SIZE_CLASS", "small"),
+	}
+
+	maxVCPUs, err := getEnvInt("MAX_VCPUS", 4)
+	if err != nil {
+		return SizingConfig{}, err
+	}
+	maxMemoryMib, err := getEnvInt("MAX_MEMORY_MIB", 4096)
+	if err != nil {
+		return SizingConfig{}, err
+	}
+	maxDiskMib, err := getEnvInt("MAX_DISK_MIB", 8192)
+	if err != nil {
+		return SizingConfig{}, err
+	}
+	sizing.MaxVCPUs = int64(maxVCPUs)
+	sizing.MaxMemoryMib = int64(maxMemoryMib)
+	sizing.MaxDiskMib = int64(maxDiskMib)
+
+	return sizing, nil
+}
+
+func loadIngressConfig() (IngressConfig, error) {
+	ingress := IngressConfig{
+		Provider:          getEnvString("INGRESS", "frpc"),
+		PublicAddress:     os.Getenv("INGRESS_PUBLIC_ADDRESS"),
+		FrpcConfigDir:     getEnvString("FRPC_CONFIG_DIR", "/etc/frp/nimbus"),
+		FrpcAdminAddr:     getEnvString("FRPC_ADMIN_ADDR", "127.0.0.1:7400"),
+		FrpcAdminUser:     os.Getenv("FRPC_ADMIN_USER"),
+		FrpcAdminPassword: os.Getenv("FRPC_ADMIN_PASSWORD"),
+	}
+
+	switch ingress.Provider {
+	case "frpc", "direct":
+		if ingress.PublicAddress == "" {
+			return IngressConfig{}, fmt.Errorf("INGRESS_PUBLIC_ADDRESS must be set for the %s ingress", ingress.Provider)
+		}
+	case "local":
+		if ingress.PublicAddress == "" {
+			ingress.PublicAddress = "127.0.0.1"
+		}
+	default:
+		return IngressConfig{}, fmt.Errorf("INGRESS must be frpc, direct or local")
+	}
+
+	return ingress, nil
+}
+
+// parseSupernet checks that a supernet can be split into /30s.
+func parseSupernet(cidr string) (*net.IPNet, error) {
+	_, supernet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if supernet.IP.To4() == nil {
+		return nil, fmt.Errorf("supernet %s is not ipv4", cidr)
+	}
+	ones, _ := supernet.Mask.Size()
+	if ones > 30 {
+		return nil, fmt.Errorf("supernet %s is smaller than a /30", cidr)
+	}
+	return supernet, nil
+}
+
+func getEnvString(key string, def string) string {
+	str := os.Getenv(key)
+	if str == "" {
+		return def
+	}
+	return str
+}
+
+func getEnvBool(key string, def bool) (bool, error) {
+	str := os.Getenv(key)
+	if str == "" {
+		return def, nil
+	}
+
+	val, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, fmt.Errorf("%s is not a boolean: %v", key, err)
+	}
+	return val, nil
+}
+
+func getEnvInt(key string, def int) (int, error) {
+	str := os.Getenv(key)
+	if str == "" {
+		return def, nil
+	}
+
+	val, err := strconv.Atoi(str)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not an integer: %v", key, err)
+	}
+	return val, nil
+}
+
+func getEnvDuration(key string, def time.Duration) (time.Duration, error) {
+	str := os.Getenv(key)
+	if str == "" {
+		return def, nil
+	}
+
+	val, err := time.ParseDuration(str)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a duration: %v", key, err)
+	}
+	return val, nil
+}
@@ -8,10 +8,11 @@ const (
 	DefaultTimeout  = time.Second * 5
 	CreateVmTimeout = time.Second * 20
 
-	FrpcPath      = "/home/linuxbrew/.linuxbrew/bin/frpc"
-	FrpcConfigDir = "/home/tswu/frpc/nimbus"
+	// how long to wait for the ingress proxies of a machine to start
+	IngressReadyTimeout = time.Second * 5
 
-	RefreshFrpcPath = "/home/tswu/refresh-frpc.sh"
+	// writing or loading the memory of a large machine takes a while
+	SnapshotTimeout = time.Minute
 
 	MinRemotePort = 8000
 	MaxRemotePort = 9000
@@ -24,8 +25,4 @@ const (
 	InternalGamePort    = 25565
 
 	DataDirPath = "./_data"
-
-	CniFirstSubnetStr = "192.168.1.0"
-	CniLastSubnetStr = "192.168.254.0"
-	PublicIpStr = "18.119.116.39"
 )
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/middle"
+)
+
+func ListSubnets(w http.ResponseWriter, r *http.Request) {
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data.Manager.SubnetUsage())
+}
+
+// ListMachines lists every machine with its owner
+func ListMachines(w http.ResponseWriter, r *http.Request) {
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	vmManager := data.Manager
+
+	type machineResponse struct {
+		userMachineResponse
+		Owner string `json:"owner,omitempty"`
+	}
+	response := []machineResponse{}
+	for _, m := range vmManager.Machines() {
+		machine := machineResponse{userMachineResponse: newUserMachineResponse(vmManager.PublicAddress(), m)}
+		if !m.Data.Owner.IsZero() {
+			machine.Owner = m.Data.Owner.String()
+		}
+		response = append(response, machine)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ForceStopMachine deletes any machine, whoever owns it
+func ForceStopMachine(w http.ResponseWriter, r *http.Request) {
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	parsed, err := uuid.Parse(r.PathValue("machineId"))
+	if err != nil {
+		http.Error(w, "Invalid machine id", http.StatusBadRequest)
+		return
+	}
+
+	result, err := data.Manager.DeleteVM(app.MachineUUID(parsed))
+	if errors.Is(err, app.ErrMachineNotFound) {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("force stop vm failed: %v", err)
+		http.Error(w, "Failed to stop machine", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if !result.Ok() {
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// ShutdownAll stops every machine
+func ShutdownAll(w http.ResponseWriter, r *http.Request) {
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err := data.Manager.GracefulShutdownAll()
+	if err != nil {
+		logrus.Errorf("shutdown all failed: %v", err)
+		http.Error(w, "Failed to shut down all machines", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type adminKeyResponse struct {
+	Id           string        `json:"id"`
+	Name         string        `json:"name"`
+	Role         app.AdminRole `json:"role"`
+	CreationTime time.Time     `json:"creation_time"`
+	// only set when the key is created
+	Key string `json:"key,omitempty"`
+}
+
+func newAdminKeyResponse(key app.AdminKey) adminKeyResponse {
+	return adminKeyResponse{
+		Id:           key.Id,
+		Name:         key.Name,
+		Role:         key.Role,
+		CreationTime: key.CreationTime,
+	}
+}
+
+// ListAdminKeys lists the stored admin keys, without the keys themselves
+func ListAdminKeys(w http.ResponseWriter, r *http.Request) {
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response := []adminKeyResponse{}
+	for _, key := range data.Manager.AdminKeys.List() {
+		response = append(response, newAdminKeyResponse(key))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// CreateAdminKey makes an admin key, the key is only ever in this response
+func CreateAdminKey(w http.ResponseWriter, r *http.Request) {
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var reqData struct {
+		Name string        `json:"name"`
+		Role app.AdminRole `json:"role"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	key, plain, err := data.Manager.AdminKeys.Create(reqData.Name, reqData.Role)
+	switch {
+	case errors.Is(err, app.ErrInvalidKeyName), errors.Is(err, app.ErrInvalidRole):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		logrus.Errorf("create admin key failed: %v", err)
+		http.Error(w, "Failed to create admin key", http.StatusInternalServerError)
+		return
+	}
+
+	response := newAdminKeyResponse(key)
+	response.Key = plain
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteAdminKey revokes an admin key
+func DeleteAdminKey(w http.ResponseWriter, r *http.Request) {
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	err := data.Manager.AdminKeys.Delete(r.PathValue("keyId"))
+	if errors.Is(err, app.ErrAdminKeyNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("delete admin key failed: %v", err)
+		http.Error(w, "Failed to delete admin key", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,22 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/middle"
+)
+
+func ListImages(w http.ResponseWriter, r *http.Request) {
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data.Manager.Images())
+}
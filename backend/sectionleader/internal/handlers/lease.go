@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
+)
+
+// RenewMachine restarts the lease of the calling machine, the body is
+// optional and without one the default lease is used
+func RenewMachine(w http.ResponseWriter, r *http.Request) {
+	machineId, vmManager, ok := machineRequestData(w, r)
+	if !ok {
+		return
+	}
+
+	var reqData struct {
+		LeaseSeconds int64 `json:"lease_seconds"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	machineData, err := vmManager.RenewLease(machineId, reqData.LeaseSeconds)
+	var quotaErr *app.QuotaError
+	switch {
+	case errors.Is(err, app.ErrMachineNotFound):
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	case errors.Is(err, app.ErrInvalidLease):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, app.ErrLeaseExpired):
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case errors.As(err, &quotaErr):
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	case err != nil:
+		logrus.Errorf("renew lease failed: %v", err)
+		http.Error(w, "Failed to renew lease", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		MachineId string     `json:"machine_id"`
+		ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	}{
+		MachineId: machineData.Id.String(),
+		ExpiresAt: expiresAt(machineData.ExpiresAt),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// expiresAt is left out of responses for machines that never expire
+func expiresAt(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
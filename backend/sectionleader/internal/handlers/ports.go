@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/middle"
+)
+
+type exposedPortResponse struct {
+	GuestPort      int    `json:"guest_port"`
+	Protocol       string `json:"protocol"`
+	HostPort       int    `json:"host_port"`
+	PublicPort     int    `json:"public_port"`
+	PublicEndpoint string `json:"public_endpoint"`
+}
+
+func newExposedPortResponse(publicAddress string, p app.ExposedPort) exposedPortResponse {
+	return exposedPortResponse{
+		GuestPort:      p.GuestPort,
+		Protocol:       string(p.Protocol),
+		HostPort:       p.HostPort,
+		PublicPort:     p.PublicPort,
+		PublicEndpoint: net.JoinHostPort(publicAddress, strconv.Itoa(p.PublicPort)),
+	}
+}
+
+func ListPorts(w http.ResponseWriter, r *http.Request) {
+	machineId, vmManager, ok := machineRequestData(w, r)
+	if !ok {
+		return
+	}
+
+	ports, err := vmManager.ListPorts(machineId)
+	if err != nil {
+		writePortError(w, err)
+		return
+	}
+
+	response := make([]exposedPortResponse, 0, len(ports))
+	for _, p := range ports {
+		response = append(response, newExposedPortResponse(vmManager.PublicAddress(), p))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func ExposePort(w http.ResponseWriter, r *http.Request) {
+	machineId, vmManager, ok := machineRequestData(w, r)
+	if !ok {
+		return
+	}
+
+	var reqData struct {
+		GuestPort int    `json:"guest_port"`
+		Protocol  string `json:"protocol"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	protocol, err := app.ParseProtocol(reqData.Protocol)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	exposed, _, err := vmManager.ExposePort(machineId, protocol, reqData.GuestPort)
+	if err != nil {
+		writePortError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newExposedPortResponse(vmManager.PublicAddress(), exposed))
+}
+
+func UnexposePort(w http.ResponseWriter, r *http.Request) {
+	machineId, vmManager, ok := machineRequestData(w, r)
+	if !ok {
+		return
+	}
+
+	guestPort, err := strconv.Atoi(r.PathValue("guestPort"))
+	if err != nil {
+		http.Error(w, "Invalid guest port", http.StatusBadRequest)
+		return
+	}
+
+	protocol, err := app.ParseProtocol(r.URL.Query().Get("protocol"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = vmManager.UnexposePort(machineId, protocol, guestPort)
+	if err != nil {
+		writePortError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// machineRequestData pulls the authenticated machine id and the manager out of
+// the request context, writing an error response if either is missing.
+func machineRequestData(w http.ResponseWriter, r *http.Request) (app.MachineUUID, *app.VMManager, bool) {
+	machineId, ok := r.Context().Value(middle.MachineIdContextDataKey).(app.MachineUUID)
+	if !ok {
+		logrus.Errorf("machine uuid data not ok")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return app.MachineUUID{}, nil, false
+	}
+
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return app.MachineUUID{}, nil, false
+	}
+
+	return machineId, data.Manager, true
+}
+
+func writePortError(w http.ResponseWriter, err error) {
+	var capacityErr *app.CapacityError
+	switch {
+	case errors.Is(err, app.ErrMachineNotFound), errors.Is(err, app.ErrPortNotExposed):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, app.ErrPortAlreadyExposed), errors.Is(err, app.ErrMachineNotRunning), errors.Is(err, app.ErrMachineHibernated):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, app.ErrTooManyPorts):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case errors.As(err, &capacityErr):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		logrus.Errorf("port request failed: %v", err)
+		http.Error(w, "Failed to update ports", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
+)
+
+type snapshotRequest struct {
+	Name string `json:"name"`
+}
+
+// CreateSnapshot snapshots the calling machine, which is paused while its
+// memory and disk are written
+func CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	machineId, vmManager, ok := machineRequestData(w, r)
+	if !ok {
+		return
+	}
+
+	var reqData snapshotRequest
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	info, err := vmManager.CreateSnapshot(machineId, reqData.Name)
+	if err != nil {
+		writeSnapshotError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(info)
+}
+
+// RestoreSnapshot brings the calling machine back to a named snapshot
+func RestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	machineId, vmManager, ok := machineRequestData(w, r)
+	if !ok {
+		return
+	}
+
+	var reqData snapshotRequest
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	machineData, err := vmManager.RestoreSnapshot(machineId, reqData.Name)
+	if err != nil {
+		writeSnapshotError(w, err)
+		return
+	}
+
+	response := struct {
+		MachineId    string                 `json:"machine_id"`
+		MachineName  string                 `json:"machine_name"`
+		Snapshot     string                 `json:"snapshot"`
+		Shape        app.MachineShape       `json:"shape"`
+		ExposedPorts []exposedPortResponse  `json:"exposed_ports"`
+		Conditions   []app.MachineCondition `json:"conditions"`
+	}{
+		MachineId:   machineData.Id.String(),
+		MachineName: machineData.Name,
+		Snapshot:    reqData.Name,
+		Shape:       machineData.Shape,
+		Conditions:  machineData.Conditions,
+	}
+	for _, p := range machineData.ExposedPorts {
+		response.ExposedPorts = append(response.ExposedPorts, newExposedPortResponse(vmManager.PublicAddress(), p))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeSnapshotError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, app.ErrInvalidSnapshotName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, app.ErrMachineNotFound), errors.Is(err, app.ErrSnapshotNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, app.ErrSnapshotExists), errors.Is(err, app.ErrMachineNotRunning):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		logrus.Errorf("snapshot request failed: %v", err)
+		http.Error(w, "Snapshot request failed", http.StatusInternalServerError)
+	}
+}
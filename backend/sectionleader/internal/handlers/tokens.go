@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/middle"
+)
+
+// RefreshToken trades a refresh token for a new access and refresh token, the
+// old refresh token can't be used again
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var reqData struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := middle.RefreshMachineTokens(reqData.RefreshToken, data)
+	if errors.Is(err, app.ErrMachineNotFound) {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("refresh token failed: %v", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// CreateToken mints an access token of the calling machine with some of the
+// scopes of the calling token, to hand to something that should do less
+func CreateToken(w http.ResponseWriter, r *http.Request) {
+	claims, data, ok := tokenRequestData(w, r)
+	if !ok {
+		return
+	}
+
+	var reqData struct {
+		Scopes     []string `json:"scopes"`
+		TtlSeconds int64    `json:"ttl_seconds"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if reqData.TtlSeconds < 0 {
+		http.Error(w, "ttl_seconds can't be negative", http.StatusBadRequest)
+		return
+	}
+
+	ttl := time.Duration(reqData.TtlSeconds) * time.Second
+	tokens, err := middle.NewScopedToken(claims, reqData.Scopes, ttl, data)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// RevokeToken revokes the calling token, or with a body another token of the
+// calling machine, which needs the tokens:write scope
+func RevokeToken(w http.ResponseWriter, r *http.Request) {
+	claims, data, ok := tokenRequestData(w, r)
+	if !ok {
+		return
+	}
+
+	var reqData struct {
+		Token string `json:"token"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if reqData.Token == "" {
+		err = middle.RevokeClaims(claims, data)
+		if errors.Is(err, app.ErrAlreadyRevoked) {
+			err = nil
+		}
+	} else {
+		if !claims.HasScope(middle.ScopeTokensWrite) {
+			http.Error(w, "Token lacks the "+middle.ScopeTokensWrite+" scope", http.StatusForbidden)
+			return
+		}
+		id, parseErr := uuid.Parse(claims.MachineId)
+		if parseErr != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		err = middle.RevokeMachineToken(reqData.Token, app.MachineUUID(id), data)
+	}
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MachineTokens hands the owner of a machine a new access and refresh token
+// for it, with all scopes unless the body asks for fewer
+func MachineTokens(w http.ResponseWriter, r *http.Request) {
+	userId, vmManager, ok := userRequestData(w, r)
+	if !ok {
+		return
+	}
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	parsed, err := uuid.Parse(r.PathValue("machineId"))
+	if err != nil {
+		http.Error(w, "Invalid machine id", http.StatusBadRequest)
+		return
+	}
+	machineId := app.MachineUUID(parsed)
+
+	var reqData struct {
+		Scopes []string `json:"scopes"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if len(reqData.Scopes) == 0 {
+		reqData.Scopes = middle.AllScopes
+	}
+
+	// machines of other users are reported as missing, like ones that never
+	// existed
+	owner, err := vmManager.MachineOwner(machineId)
+	if err != nil || owner.IsZero() || owner != userId {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	}
+
+	tokens, err := middle.NewMachineTokens(machineId, reqData.Scopes, data)
+	if err != nil {
+		writeTokenError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// tokenRequestData pulls the claims of the calling token and the common data
+// out of the request context, writing an error response if either is missing.
+func tokenRequestData(w http.ResponseWriter, r *http.Request) (*middle.TokenClaims, middle.CommonContextData, bool) {
+	claims, ok := r.Context().Value(middle.TokenClaimsContextDataKey).(*middle.TokenClaims)
+	if !ok {
+		logrus.Errorf("token claims not ok")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, middle.CommonContextData{}, false
+	}
+
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return nil, middle.CommonContextData{}, false
+	}
+
+	return claims, data, true
+}
+
+func writeTokenError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, middle.ErrInvalidScope), errors.Is(err, middle.ErrInvalidToken):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, middle.ErrScopeNotHeld), errors.Is(err, middle.ErrNotOwnedToken):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		logrus.Errorf("token request failed: %v", err)
+		http.Error(w, "Failed to handle token", http.StatusInternalServerError)
+	}
+}
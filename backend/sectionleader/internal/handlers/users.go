@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/middle"
+)
+
+type credentialsRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Register creates a user account
+func Register(w http.ResponseWriter, r *http.Request) {
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var reqData credentialsRequest
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	user, err := data.Manager.Users.Register(reqData.Username, reqData.Password)
+	switch {
+	case errors.Is(err, app.ErrInvalidUsername), errors.Is(err, app.ErrInvalidPassword):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, app.ErrUserExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		logrus.Errorf("register failed: %v", err)
+		http.Error(w, "Failed to register", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		UserId   string `json:"user_id"`
+		Username string `json:"username"`
+	}{
+		UserId:   user.Id.String(),
+		Username: user.Name,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Login hands out a user token for the routes of the account
+func Login(w http.ResponseWriter, r *http.Request) {
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var reqData credentialsRequest
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	user, err := data.Manager.Users.Authenticate(reqData.Username, reqData.Password)
+	if errors.Is(err, app.ErrInvalidCredentials) {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("login failed: %v", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	tokenStr, tokenExpiresAt, err := middle.NewUserJwt(user.Id, data)
+	if err != nil {
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		UserId         string    `json:"user_id"`
+		Username       string    `json:"username"`
+		Token          string    `json:"token"`
+		TokenExpiresAt time.Time `json:"token_expires_at"`
+	}{
+		UserId:         user.Id.String(),
+		Username:       user.Name,
+		Token:          tokenStr,
+		TokenExpiresAt: tokenExpiresAt,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+type userMachineResponse struct {
+	MachineId    string                `json:"machine_id"`
+	MachineName  string                `json:"machine_name"`
+	State        string                `json:"state"`
+	Shape        app.MachineShape      `json:"shape"`
+	Image        string                `json:"image"`
+	RemotePort   int                   `json:"remote_port"`
+	ExposedPorts []exposedPortResponse `json:"exposed_ports"`
+	CreationTime time.Time             `json:"creation_time"`
+	ExpiresAt    *time.Time            `json:"expires_at,omitempty"`
+}
+
+func newUserMachineResponse(publicAddress string, m app.UserMachine) userMachineResponse {
+	machine := userMachineResponse{
+		MachineId:    m.Data.Id.String(),
+		MachineName:  m.Data.Name,
+		State:        m.State.String(),
+		Shape:        m.Data.Shape,
+		Image:        m.Data.Image,
+		RemotePort:   m.Data.RemotePort,
+		CreationTime: m.Data.CreationTime,
+		ExpiresAt:    expiresAt(m.Data.ExpiresAt),
+	}
+	for _, p := range m.Data.ExposedPorts {
+		machine.ExposedPorts = append(machine.ExposedPorts, newExposedPortResponse(publicAddress, p))
+	}
+	return machine
+}
+
+// MyMachines lists the machines of the calling user, with what they hold
+// against the quota
+func MyMachines(w http.ResponseWriter, r *http.Request) {
+	userId, vmManager, ok := userRequestData(w, r)
+	if !ok {
+		return
+	}
+
+	machines, usage := vmManager.UserMachines(userId)
+	quota := vmManager.Quota(userId)
+
+	// zero limits are no limit
+	response := struct {
+		Machines []userMachineResponse `json:"machines"`
+		Usage    app.Usage             `json:"usage"`
+		Quota    struct {
+			MaxMachines     int   `json:"max_machines"`
+			MaxVCPUs        int64 `json:"max_vcpus"`
+			MaxMemoryMib    int64 `json:"max_memory_mib"`
+			MaxLeaseSeconds int64 `json:"max_lease_seconds"`
+		} `json:"quota"`
+	}{
+		Machines: []userMachineResponse{},
+		Usage:    usage,
+	}
+	response.Quota.MaxMachines = quota.MaxMachines
+	response.Quota.MaxVCPUs = quota.MaxVCPUs
+	response.Quota.MaxMemoryMib = quota.MaxMemoryMib
+	response.Quota.MaxLeaseSeconds = int64(quota.MaxLease / time.Second)
+	for _, m := range machines {
+		response.Machines = append(response.Machines, newUserMachineResponse(vmManager.PublicAddress(), m))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// userRequestData pulls the authenticated user id and the manager out of the
+// request context, writing an error response if either is missing.
+func userRequestData(w http.ResponseWriter, r *http.Request) (app.UserUUID, *app.VMManager, bool) {
+	userId, ok := r.Context().Value(middle.UserIdContextDataKey).(app.UserUUID)
+	if !ok {
+		logrus.Errorf("user id data not ok")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return app.UserUUID{}, nil, false
+	}
+
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return app.UserUUID{}, nil, false
+	}
+
+	return userId, data.Manager, true
+}
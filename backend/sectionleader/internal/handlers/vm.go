@@ -2,7 +2,9 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"time"
 
@@ -21,7 +23,56 @@ func NewMachine(w http.ResponseWriter, r *http.Request) {
 	}
 	vmManager := data.Manager
 
-	outputChan, err := vmManager.CreateVM()
+	owner, loggedIn := r.Context().Value(middle.UserIdContextDataKey).(app.UserUUID)
+	if !loggedIn && !vmManager.AllowAnonymous() {
+		http.Error(w, "Log in to create machines", http.StatusUnauthorized)
+		return
+	}
+
+	// the body is optional, without one the default image and size class are
+	// used
+	var reqData struct {
+		app.ShapeRequest
+		Image         string   `json:"image"`
+		SshPublicKeys []string `json:"ssh_public_keys"`
+		LeaseSeconds  int64    `json:"lease_seconds"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&reqData)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	shape, err := vmManager.ResolveShape(reqData.ShapeRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	img, err := vmManager.ResolveImage(reqData.Image)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	keys, err := app.ParseAuthorizedKeys(reqData.SshPublicKeys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	lease, err := vmManager.ResolveLease(shape, reqData.LeaseSeconds)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	outputChan, err := vmManager.CreateVM(owner, shape, img, keys, lease)
+	var quotaErr *app.QuotaError
+	if errors.As(err, &quotaErr) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		logrus.Errorf("create vm failed: %v", err)
 		http.Error(w, "Failed to create VM", http.StatusInternalServerError)
@@ -31,51 +82,72 @@ func NewMachine(w http.ResponseWriter, r *http.Request) {
 	var createMachineRes *app.MachineData
 
 	select {
-	case createMachineRes = <-outputChan:
-		if createMachineRes == nil {
-			logrus.Errorf("create vm returned nil data pointer")
+	case res := <-outputChan:
+		var capacityErr *app.CapacityError
+		if errors.As(res.Err, &capacityErr) {
+			logrus.Errorf("create vm failed: %v", res.Err)
+			http.Error(w, "No capacity for new machines, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		if res.Err != nil || res.Data == nil {
+			logrus.Errorf("create vm failed: %v", res.Err)
 			http.Error(w, "Failed to create VM", http.StatusInternalServerError)
 			return
 		}
+		createMachineRes = res.Data
 	case <-time.After(constants.CreateVmTimeout):
 		logrus.Errorf("create machine timed out")
 		http.Error(w, "timed out creating VM", http.StatusInternalServerError)
 		return
 	}
 
-	tokenStr, err := middle.NewJwt(createMachineRes.Id, data.SecretKey)
+	tokens, err := middle.NewMachineTokens(createMachineRes.Id, middle.AllScopes, data)
 	if err != nil {
 		logrus.Errorf("new jwt failed: %v", err)
 		http.Error(w, "Failed to create token", http.StatusInternalServerError)
 		return
 	}
 
-	// modify frp config
-	err = CreateTomlFrpcConfig(createMachineRes)
-	if err != nil {
-		logrus.Errorf("create toml frpc config failed: %v", err)
-		http.Error(w, "Failed to create reverse proxy config", http.StatusInternalServerError)
-		return
-	}
-
 	response := struct {
 		MachineId      string `json:"machine_id"`
 		MachineName    string `json:"machine_name"`
 		LocalIp        string `json:"local_ip"`
 		Token          string `json:"token"`
+		TokenExpiresAt time.Time `json:"token_expires_at"`
+		RefreshToken   string `json:"refresh_token"`
+		Scopes         []string `json:"scopes"`
 		RemotePort     int    `json:"remote_port"`       // SSH remote port
 		LocalPort      int    `json:"local_port"`        // Local port for game forwarding
 		GameRemotePort int    `json:"game_remote_port"`  // Remote port for game access
 		RemoteIp       string `json:"remote_ip"`
+		ExposedPorts   []exposedPortResponse `json:"exposed_ports"`
+		Conditions     []app.MachineCondition `json:"conditions"`
+		Shape          app.MachineShape       `json:"shape"`
+		Image          string                 `json:"image"`
+		User           string                 `json:"user"`
+		SshPublicKeys  []string               `json:"ssh_public_keys,omitempty"`
+		ExpiresAt      *time.Time             `json:"expires_at,omitempty"`
 	}{
 		MachineId:      createMachineRes.Id.String(),
 		MachineName:    createMachineRes.Name,
 		LocalIp:        createMachineRes.LocalIp.IP.String(),
-		Token:          tokenStr,
+		Token:          tokens.Token,
+		TokenExpiresAt: tokens.TokenExpiresAt,
+		RefreshToken:   tokens.RefreshToken,
+		Scopes:         tokens.Scopes,
 		RemotePort:     createMachineRes.RemotePort,
 		LocalPort:      createMachineRes.LocalPort,
 		GameRemotePort: createMachineRes.GameRemotePort,
-		RemoteIp:       constants.PublicIpStr,
+		RemoteIp:       vmManager.PublicAddress(),
+		Conditions:     createMachineRes.Conditions,
+		Shape:          createMachineRes.Shape,
+		Image:          createMachineRes.Image,
+		User:           createMachineRes.User,
+		SshPublicKeys:  createMachineRes.AuthorizedKeys,
+		ExpiresAt:      expiresAt(createMachineRes.ExpiresAt),
+	}
+	for _, p := range createMachineRes.ExposedPorts {
+		response.ExposedPorts = append(response.ExposedPorts, newExposedPortResponse(vmManager.PublicAddress(), p))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -100,6 +172,10 @@ func SshKey(w http.ResponseWriter, r *http.Request) {
 	vmManager := data.Manager
 
 	key, err := vmManager.GetSshKey(machineId)
+	if errors.Is(err, app.ErrNoSshKey) || errors.Is(err, app.ErrMachineNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		logrus.Errorf("could not load machine ssh key, %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -119,34 +195,171 @@ func SshKey(w http.ResponseWriter, r *http.Request) {
 	w.Write(key)
 }
 
-func ShutdownAll(w http.ResponseWriter, r *http.Request) {
-	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+// MachineStatus reports the state and the conditions of the calling machine
+func MachineStatus(w http.ResponseWriter, r *http.Request) {
+	machineId, vmManager, ok := machineRequestData(w, r)
 	if !ok {
-		logrus.Errorf("common context data not ok: %v", data)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	vmManager := data.Manager
 
-	type requestData struct {
-		SecretKey string `json:"secret_key"`
+	state, machineData, err := vmManager.MachineStatus(machineId)
+	if errors.Is(err, app.ErrMachineNotFound) {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
 	}
-	
-	var reqData requestData
-	err := json.NewDecoder(r.Body).Decode(&reqData)
 	if err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		logrus.Errorf("machine status failed: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	
-	if reqData.SecretKey != data.SecretKey {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+	response := struct {
+		MachineId   string                 `json:"machine_id"`
+		MachineName string                 `json:"machine_name"`
+		State       string                 `json:"state"`
+		Conditions  []app.MachineCondition `json:"conditions"`
+		ExpiresAt   *time.Time             `json:"expires_at,omitempty"`
+	}{
+		MachineId:   machineData.Id.String(),
+		MachineName: machineData.Name,
+		State:       state.String(),
+		Conditions:  machineData.Conditions,
+		ExpiresAt:   expiresAt(machineData.ExpiresAt),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// PauseMachine pauses the calling machine
+func PauseMachine(w http.ResponseWriter, r *http.Request) {
+	setMachinePaused(w, r, true)
+}
+
+// ResumeMachine resumes the calling machine
+func ResumeMachine(w http.ResponseWriter, r *http.Request) {
+	setMachinePaused(w, r, false)
+}
+
+func setMachinePaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	machineId, vmManager, ok := machineRequestData(w, r)
+	if !ok {
+		return
+	}
+
+	var state app.VMState
+	var err error
+	if paused {
+		state, err = vmManager.PauseVM(machineId)
+	} else {
+		state, err = vmManager.ResumeVM(machineId)
+	}
+
+	var transitionErr *app.InvalidTransitionError
+	switch {
+	case errors.Is(err, app.ErrMachineNotFound):
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	case errors.As(err, &transitionErr), errors.Is(err, app.ErrMachineHibernated):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		logrus.Errorf("pause or resume failed: %v", err)
+		http.Error(w, "Failed to change machine state", http.StatusInternalServerError)
 		return
 	}
 
-	vmManager.GracefulShutdownAll()
+	response := struct {
+		MachineId string `json:"machine_id"`
+		State     string `json:"state"`
+	}{
+		MachineId: machineId.String(),
+		State:     state.String(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// WakeMachine restores the calling machine if it is hibernated, or resumes it
+// if it is paused
+func WakeMachine(w http.ResponseWriter, r *http.Request) {
+	machineId, vmManager, ok := machineRequestData(w, r)
+	if !ok {
+		return
+	}
+
+	machineData, err := vmManager.WakeVM(machineId)
+	var transitionErr *app.InvalidTransitionError
+	switch {
+	case errors.Is(err, app.ErrMachineNotFound):
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	case errors.As(err, &transitionErr):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		logrus.Errorf("wake failed: %v", err)
+		http.Error(w, "Failed to wake machine", http.StatusInternalServerError)
+		return
+	}
+
+	response := struct {
+		MachineId    string                 `json:"machine_id"`
+		MachineName  string                 `json:"machine_name"`
+		State        string                 `json:"state"`
+		ExposedPorts []exposedPortResponse  `json:"exposed_ports"`
+		Conditions   []app.MachineCondition `json:"conditions"`
+	}{
+		MachineId:   machineData.Id.String(),
+		MachineName: machineData.Name,
+		State:       app.StateActive.String(),
+		Conditions:  machineData.Conditions,
+	}
+	for _, p := range machineData.ExposedPorts {
+		response.ExposedPorts = append(response.ExposedPorts, newExposedPortResponse(vmManager.PublicAddress(), p))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
 }
 
 func StopMachine(w http.ResponseWriter, r *http.Request) {
+	machineId, ok := r.Context().Value(middle.MachineIdContextDataKey).(app.MachineUUID)
+	if !ok {
+		logrus.Errorf("machine uuid data not ok")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data, ok := r.Context().Value(middle.CommonContextDataKey).(middle.CommonContextData)
+	if !ok {
+		logrus.Errorf("common context data not ok: %v", data)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	vmManager := data.Manager
+
+	result, err := vmManager.DeleteVM(machineId)
+	if errors.Is(err, app.ErrMachineNotFound) {
+		http.Error(w, "Machine not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("delete vm failed: %v", err)
+		http.Error(w, "Failed to stop machine", http.StatusInternalServerError)
+		return
+	}
 
+	status := http.StatusOK
+	if !result.Ok() {
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
 }
@@ -0,0 +1,263 @@
+// Package images is the catalog of machine images. Every image is a directory
+// holding an image.toml manifest, a kernel and a squashfs root filesystem:
+//
+//	name = "default"            # defaults to the directory name
+//	description = "Ubuntu 24.04"
+//	kernel = "vmlinux"          # relative to the image directory
+//	kernel_sha256 = "..."
+//	rootfs = "squashfs"
+//	rootfs_sha256 = "..."
+//	boot_args = "console=ttyS0 reboot=k panic=1 pci=off"
+//	default_user = "root"
+//
+//	[metadata]
+//	distro = "ubuntu"
+package images
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+)
+
+const manifestName = "image.toml"
+
+// boot args of machines started from the legacy ./_ref layout, before there
+// were image manifests
+const legacyBootArgs = "ro console=ttyS0 noapic reboot=k panic=1 pci=off nomodules"
+
+var (
+	ErrImageNotFound    = errors.New("image does not exist")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+
+	validName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+)
+
+// Image is one entry of the catalog. Kernel and Rootfs are absolute paths
+// once loaded.
+type Image struct {
+	Name         string            `toml:"name" json:"name"`
+	Description  string            `toml:"description" json:"description"`
+	Kernel       string            `toml:"kernel" json:"-"`
+	KernelSha256 string            `toml:"kernel_sha256" json:"-"`
+	Rootfs       string            `toml:"rootfs" json:"-"`
+	RootfsSha256 string            `toml:"rootfs_sha256" json:"-"`
+	BootArgs     string            `toml:"boot_args" json:"boot_args"`
+	DefaultUser  string            `toml:"default_user" json:"default_user"`
+	Metadata     map[string]string `toml:"metadata" json:"metadata"`
+}
+
+// fileStamp identifies the content of a file that was already hashed, so
+// unchanged files are not hashed again on every use.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+type Catalog struct {
+	mutex    sync.Mutex
+	dir      string
+	images   map[string]Image
+	verified map[string]fileStamp
+}
+
+// Load reads every image directory under dir. Images with a broken manifest
+// are skipped with an error in the log, a missing dir is an empty catalog.
+func Load(dir string) (*Catalog, error) {
+	catalog := &Catalog{
+		dir:      dir,
+		images:   make(map[string]Image),
+		verified: make(map[string]fileStamp),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		logrus.Warnf("image directory %s does not exist", dir)
+		return catalog, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		img, err := loadImage(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			logrus.Errorf("skipping image %s: %v", entry.Name(), err)
+			continue
+		}
+		catalog.images[img.Name] = img
+		logrus.Infof("loaded image %s", img.Name)
+	}
+
+	return catalog, nil
+}
+
+func loadImage(imageDir string) (Image, error) {
+	var img Image
+	_, err := toml.DecodeFile(filepath.Join(imageDir, manifestName), &img)
+	if err != nil {
+		return Image{}, err
+	}
+
+	if img.Name == "" {
+		img.Name = filepath.Base(imageDir)
+	}
+	if !validName.MatchString(img.Name) {
+		return Image{}, fmt.Errorf("invalid image name %q", img.Name)
+	}
+	if img.Kernel == "" || img.Rootfs == "" {
+		return Image{}, fmt.Errorf("kernel and rootfs must be set")
+	}
+	if img.KernelSha256 == "" || img.RootfsSha256 == "" {
+		return Image{}, fmt.Errorf("kernel_sha256 and rootfs_sha256 must be set")
+	}
+	if img.DefaultUser == "" {
+		img.DefaultUser = "root"
+	}
+
+	img.Kernel, err = filepath.Abs(filepath.Join(imageDir, img.Kernel))
+	if err != nil {
+		return Image{}, err
+	}
+	img.Rootfs, err = filepath.Abs(filepath.Join(imageDir, img.Rootfs))
+	if err != nil {
+		return Image{}, err
+	}
+
+	return img, nil
+}
+
+// AddLegacy adds an image called name made of the vmlinux and squashfs in
+// refDir, the layout used before image manifests. It has no checksums to
+// check against, so the files are hashed now and trusted as they are.
+func (c *Catalog) AddLegacy(name string, refDir string) (Image, error) {
+	img := Image{
+		Name:        name,
+		Description: "legacy image from " + refDir,
+		BootArgs:    legacyBootArgs,
+		DefaultUser: "root",
+	}
+
+	var err error
+	img.Kernel, err = filepath.Abs(filepath.Join(refDir, "vmlinux"))
+	if err != nil {
+		return Image{}, err
+	}
+	img.Rootfs, err = filepath.Abs(filepath.Join(refDir, "squashfs"))
+	if err != nil {
+		return Image{}, err
+	}
+	img.KernelSha256, err = sha256File(img.Kernel)
+	if err != nil {
+		return Image{}, err
+	}
+	img.RootfsSha256, err = sha256File(img.Rootfs)
+	if err != nil {
+		return Image{}, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.images[name] = img
+
+	logrus.Warnf("using legacy image %s from %s, move it to %s with an %s to keep it checked",
+		name, refDir, filepath.Join(c.dir, name), manifestName)
+	return img, nil
+}
+
+// List returns every image sorted by name.
+func (c *Catalog) List() []Image {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	list := make([]Image, 0, len(c.images))
+	for _, img := range c.images {
+		list = append(list, img)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+func (c *Catalog) Get(name string) (Image, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	img, ok := c.images[name]
+	if !ok {
+		return Image{}, fmt.Errorf("%w: %s", ErrImageNotFound, name)
+	}
+	return img, nil
+}
+
+// Verify checks the kernel and rootfs of an image against their checksums.
+// Files are only hashed again if their size or modification time changed.
+func (c *Catalog) Verify(img Image) error {
+	err := c.verifyFile(img.Kernel, img.KernelSha256)
+	if err != nil {
+		return fmt.Errorf("image %s kernel: %w", img.Name, err)
+	}
+	err = c.verifyFile(img.Rootfs, img.RootfsSha256)
+	if err != nil {
+		return fmt.Errorf("image %s rootfs: %w", img.Name, err)
+	}
+	return nil
+}
+
+func (c *Catalog) verifyFile(path string, expected string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	stamp := fileStamp{info.Size(), info.ModTime()}
+
+	c.mutex.Lock()
+	known, ok := c.verified[path]
+	c.mutex.Unlock()
+	if ok && known.size == stamp.size && known.modTime.Equal(stamp.modTime) {
+		return nil
+	}
+
+	sum, err := sha256File(path)
+	if err != nil {
+		return err
+	}
+	if sum != expected {
+		return fmt.Errorf("%w: %s is %s, expected %s", ErrChecksumMismatch, path, sum, expected)
+	}
+
+	c.mutex.Lock()
+	c.verified[path] = stamp
+	c.mutex.Unlock()
+	return nil
+}
+
+func sha256File(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
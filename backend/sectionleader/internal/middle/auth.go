@@ -2,80 +2,138 @@ package middle
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
-	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
 )
 
-func NewJwt(id app.MachineUUID, secretKey string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
-		jwt.MapClaims{
-			"machineId": id.String(),
-			"iat":       time.Now().Unix(),
-		})
+// CheckJwt guards the routes of a machine, the Authorization header has to
+// hold an access token of the machine that has not expired or been revoked.
+func CheckJwt(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		data, ok := r.Context().Value(CommonContextDataKey).(CommonContextData)
+		if !ok {
+			logrus.Errorf("common context data not ok: %v", data)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 
-	tokenStr, err := token.SignedString([]byte(secretKey))
-	if err != nil {
-		logrus.Errorf("new jwt signedstring failed: %v", err)
-		return "", err
-	}
+		principal, err := MachineJwt{}.Authenticate(r, data)
+		if err != nil {
+			logrus.Errorf("auth failed: %v", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		claims := principal.Machine
+		logrus.Infof("jwt parsed for %s", claims.MachineId)
 
-	return tokenStr, nil
+		newUUID, err := uuid.Parse(claims.MachineId)
+		if err != nil {
+			logrus.Errorf("uuid frombytes error: %v", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		machineId := app.MachineUUID(newUUID)
+
+		newCtx := context.WithValue(r.Context(), MachineIdContextDataKey, machineId)
+		newCtx = context.WithValue(newCtx, TokenClaimsContextDataKey, claims)
+		next.ServeHTTP(w, r.WithContext(newCtx))
+	})
 }
 
-func CheckJwt(next http.Handler) http.Handler {
+// RequireScope lets through requests whose machine token holds scope, it has
+// to sit behind CheckJwt.
+func RequireScope(scope string, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := r.Context().Value(TokenClaimsContextDataKey).(*TokenClaims)
+		if !ok {
+			logrus.Errorf("token claims not ok")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 
+		if !claims.HasScope(scope) {
+			http.Error(w, fmt.Sprintf("Token lacks the %s scope", scope), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CheckUser guards the routes of a user account, the request has to pass one
+// of the configured user authenticators.
+func CheckUser(next http.Handler) http.Handler {
+	return withUser(next, true)
+}
+
+// WithUser is CheckUser for routes that also take anonymous requests, a
+// request without credentials goes through without a user.
+func WithUser(next http.Handler) http.Handler {
+	return withUser(next, false)
+}
+
+func withUser(next http.Handler, required bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		data, ok := r.Context().Value(CommonContextDataKey).(CommonContextData)
 		if !ok {
 			logrus.Errorf("common context data not ok: %v", data)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
-		secretKey := data.SecretKey
-
-		tokenString := r.Header.Get("Authorization")
-
-		parserOpt := jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()})
-		parser := jwt.NewParser(parserOpt)
 
-		token, err := parser.Parse(tokenString, func(token *jwt.Token) (any, error) {
-			return []byte(secretKey), nil
-		})
+		principal, err := authenticate(data.UserAuth, r, data)
+		if errors.Is(err, ErrNoCredentials) && !required {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			logrus.Errorf("user auth failed: %v", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		userId := principal.User
+		// a token is only good while its user exists
+		_, err = data.Manager.Users.Get(userId)
 		if err != nil {
-			logrus.Errorf("auth failed: %v", err)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			machineIdStr, ok := claims["machineId"].(string)
-			if !ok {
-				logrus.Errorf("token parse error")
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-			logrus.Infof("jwt parsed for %s", machineIdStr)
-
-			newUUID, err := uuid.Parse(machineIdStr)
-			if err != nil {
-				logrus.Errorf("uuid frombytes error: %v", err)
-				http.Error(w, "Internal server error", http.StatusInternalServerError)
-				return
-			}
-
-			machineId := app.MachineUUID(newUUID)
-
-			newCtx := context.WithValue(r.Context(), MachineIdContextDataKey, machineId)
-			next.ServeHTTP(w, r.WithContext(newCtx))
-		} else {
-			logrus.Errorf("token parse error")
+		newCtx := context.WithValue(r.Context(), UserIdContextDataKey, userId)
+		next.ServeHTTP(w, r.WithContext(newCtx))
+	})
+}
+
+// CheckAdmin guards admin routes, the Authorization header has to hold an
+// admin API key whose role allows role, with or without the Bearer prefix.
+func CheckAdmin(role app.AdminRole, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := r.Context().Value(CommonContextDataKey).(CommonContextData)
+		if !ok {
+			logrus.Errorf("common context data not ok: %v", data)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
+
+		key, err := data.Manager.AdminKeys.Authenticate(bearerToken(r))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !key.Role.Allows(role) {
+			http.Error(w, fmt.Sprintf("Admin key lacks the %s role", role), http.StatusForbidden)
+			return
+		}
+		logrus.Infof("admin request %s %s with key %s (%s)", r.Method, r.URL.Path, key.Id, key.Name)
+
+		newCtx := context.WithValue(r.Context(), AdminKeyContextDataKey, key)
+		next.ServeHTTP(w, r.WithContext(newCtx))
 	})
 }
@@ -0,0 +1,48 @@
+package middle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
+)
+
+func TestCheckAdmin(t *testing.T) {
+	data := newTestContextData()
+	data.Manager.AdminKeys = app.NewAdminKeyRegistry(nil, "")
+	_, admin, err := data.Manager.AdminKeys.Create("ops", app.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, readOnly, err := data.Manager.AdminKeys.Create("dashboard", app.RoleReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{name: "bare key", header: admin, want: http.StatusOK},
+		{name: "bearer key", header: "Bearer " + admin, want: http.StatusOK},
+		{name: "role too low", header: "Bearer " + readOnly, want: http.StatusForbidden},
+		{name: "wrong key", header: "Bearer nimbus_wrong", want: http.StatusUnauthorized},
+		{name: "no key", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := WithData(data, CheckAdmin(app.RoleOperator, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+			r := httptest.NewRequest(http.MethodPost, "/admin/machines/x/stop", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
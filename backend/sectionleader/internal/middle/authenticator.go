@@ -0,0 +1,151 @@
+package middle
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/config"
+)
+
+// ErrNoCredentials is returned by an Authenticator when the request carries
+// no credentials of its kind, so that the next one can be tried.
+var ErrNoCredentials = errors.New("no credentials")
+
+// Principal is who a request was authenticated as, a machine token or a user.
+type Principal struct {
+	Machine *TokenClaims
+	User    app.UserUUID
+}
+
+// Authenticator checks the credentials of a request.
+type Authenticator interface {
+	Authenticate(r *http.Request, data CommonContextData) (Principal, error)
+}
+
+// NewUserAuthenticators returns the authenticators of the configured auth
+// methods, in order.
+func NewUserAuthenticators(cfg config.AuthConfig) ([]Authenticator, error) {
+	var authenticators []Authenticator
+	for _, method := range cfg.Methods {
+		switch method {
+		case "jwt":
+			authenticators = append(authenticators, UserJwt{})
+		case "oidc":
+			authenticators = append(authenticators, NewOIDCAuthenticator(cfg.OIDC))
+		case "header":
+			authenticators = append(authenticators, TrustedHeader{cfg.TrustedHeader})
+		default:
+			return nil, fmt.Errorf("unknown auth method %q", method)
+		}
+	}
+	return authenticators, nil
+}
+
+// authenticate tries authenticators in order, until one finds credentials.
+func authenticate(authenticators []Authenticator, r *http.Request, data CommonContextData) (Principal, error) {
+	for _, authenticator := range authenticators {
+		principal, err := authenticator.Authenticate(r, data)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+	return Principal{}, ErrNoCredentials
+}
+
+// MachineJwt accepts the access tokens of machines.
+type MachineJwt struct{}
+
+func (MachineJwt) Authenticate(r *http.Request, data CommonContextData) (Principal, error) {
+	tokenString := bearerToken(r)
+	if tokenString == "" {
+		return Principal{}, ErrNoCredentials
+	}
+
+	claims, err := parseToken(tokenString, audienceMachine, data)
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{Machine: claims}, nil
+}
+
+// UserJwt accepts the tokens handed out on login.
+type UserJwt struct{}
+
+func (UserJwt) Authenticate(r *http.Request, data CommonContextData) (Principal, error) {
+	tokenString := bearerToken(r)
+	if tokenString == "" {
+		return Principal{}, ErrNoCredentials
+	}
+	if alg := signingAlg(tokenString); alg != "" && alg != jwt.SigningMethodHS256.Alg() {
+		return Principal{}, ErrNoCredentials
+	}
+
+	claims, err := parseToken(tokenString, audienceUser, data)
+	if err != nil {
+		return Principal{}, err
+	}
+	id, err := uuid.Parse(claims.UserId)
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{User: app.UserUUID(id)}, nil
+}
+
+// bearerToken is the token in the Authorization header, which may or may not
+// have the Bearer prefix.
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// signingAlg is the alg in the header of a token, without checking the
+// token, so that tokens of an OIDC issuer in the same header are left to its
+// authenticator. It is empty for malformed tokens, which every authenticator
+// rejects.
+func signingAlg(tokenString string) string {
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return ""
+	}
+	return token.Method.Alg()
+}
+
+// TrustedHeader accepts the user name a proxy in front of the server has put
+// in a header, for when the server sits behind a portal that signs users in.
+// The proxy has to set the header on every request, overwriting what the
+// client sent.
+type TrustedHeader struct {
+	cfg config.TrustedHeaderConfig
+}
+
+func (a TrustedHeader) Authenticate(r *http.Request, data CommonContextData) (Principal, error) {
+	name := strings.TrimSpace(r.Header.Get(a.cfg.Header))
+	if name == "" {
+		return Principal{}, ErrNoCredentials
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return Principal{}, err
+	}
+	ip := net.ParseIP(host)
+	trusted := slices.ContainsFunc(a.cfg.TrustedProxies, func(ipNet *net.IPNet) bool {
+		return ip != nil && ipNet.Contains(ip)
+	})
+	if !trusted {
+		return Principal{}, fmt.Errorf("%s header from untrusted address %s", a.cfg.Header, host)
+	}
+
+	user, err := data.Manager.Users.EnsureExternal("header|"+name, name)
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{User: user.Id}, nil
+}
@@ -0,0 +1,220 @@
+package middle
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/config"
+)
+
+// the keys of the issuer are fetched again when a token names an unknown
+// one, but not more often than this
+const jwksRefetchInterval = time.Minute
+
+// OIDCAuthenticator accepts bearer tokens signed by an OpenID Connect issuer.
+// The user is found by the subject of the token, and made the first time
+// they are seen.
+type OIDCAuthenticator struct {
+	cfg    config.OIDCConfig
+	client *http.Client
+
+	mutex     sync.Mutex
+	jwksUrl   string
+	keys      map[string]any
+	fetchedAt time.Time
+}
+
+func NewOIDCAuthenticator(cfg config.OIDCConfig) *OIDCAuthenticator {
+	return &OIDCAuthenticator{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		jwksUrl: cfg.JwksUrl,
+		keys:    make(map[string]any),
+	}
+}
+
+func (a *OIDCAuthenticator) Authenticate(r *http.Request, data CommonContextData) (Principal, error) {
+	tokenString := bearerToken(r)
+	if tokenString == "" || signingAlg(tokenString) == jwt.SigningMethodHS256.Alg() {
+		return Principal{}, ErrNoCredentials
+	}
+
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(a.cfg.Issuer),
+		jwt.WithAudience(a.cfg.Audience),
+		jwt.WithExpirationRequired(),
+	)
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(tokenString, claims, a.key)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return Principal{}, fmt.Errorf("token has no subject")
+	}
+	name, _ := claims[a.cfg.UsernameClaim].(string)
+
+	user, err := data.Manager.Users.EnsureExternal(a.cfg.Issuer+"|"+subject, name)
+	if err != nil {
+		return Principal{}, err
+	}
+	return Principal{User: user.Id}, nil
+}
+
+// key is the jwt.Keyfunc, it finds the key named by the kid of the token.
+func (a *OIDCAuthenticator) key(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	key, ok := a.keys[kid]
+	if ok {
+		return key, nil
+	}
+	if time.Since(a.fetchedAt) < jwksRefetchInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	err := a.fetchKeys()
+	if err != nil {
+		return nil, err
+	}
+	key, ok = a.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// fetchKeys replaces the keys with the JWKS of the issuer, must be called
+// with a.mutex held.
+func (a *OIDCAuthenticator) fetchKeys() error {
+	a.fetchedAt = time.Now()
+
+	if a.jwksUrl == "" {
+		var discovery struct {
+			JwksUri string `json:"jwks_uri"`
+		}
+		err := a.getJson(a.cfg.Issuer+"/.well-known/openid-configuration", &discovery)
+		if err != nil {
+			return fmt.Errorf("oidc discovery: %w", err)
+		}
+		if discovery.JwksUri == "" {
+			return fmt.Errorf("oidc discovery: no jwks_uri")
+		}
+		a.jwksUrl = discovery.JwksUri
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := a.getJson(a.jwksUrl, &jwks)
+	if err != nil {
+		return fmt.Errorf("fetch jwks: %w", err)
+	}
+
+	keys := make(map[string]any)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			logrus.Errorf("skipping oidc signing key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	a.keys = keys
+
+	logrus.Infof("fetched %d oidc signing keys from %s", len(keys), a.jwksUrl)
+	return nil
+}
+
+func (a *OIDCAuthenticator) getJson(url string, v any) error {
+	resp, err := a.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// jsonWebKey is an RSA or EC public key of a JWKS.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("bad rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
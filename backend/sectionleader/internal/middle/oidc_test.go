@@ -0,0 +1,313 @@
+package middle
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/config"
+)
+
+const testAudience = "nimbus"
+
+// fakeIssuer serves the discovery document and the JWKS of an OIDC issuer,
+// and signs tokens with its keys.
+type fakeIssuer struct {
+	*httptest.Server
+
+	mutex      sync.Mutex
+	keys       map[string]*rsa.PrivateKey
+	jwksCounts int
+}
+
+func newFakeIssuer(t *testing.T) *fakeIssuer {
+	issuer := &fakeIssuer{keys: make(map[string]*rsa.PrivateKey)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":   issuer.URL,
+			"jwks_uri": issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", issuer.serveJwks)
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (f *fakeIssuer) serveJwks(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.jwksCounts++
+
+	keys := []jsonWebKey{}
+	for kid, key := range f.keys {
+		keys = append(keys, jsonWebKey{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+}
+
+func (f *fakeIssuer) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.keys[kid] = key
+	return key
+}
+
+func (f *fakeIssuer) fetches() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.jwksCounts
+}
+
+func (f *fakeIssuer) claims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":                f.URL,
+		"aud":                testAudience,
+		"sub":                "user-1",
+		"preferred_username": "alice",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func signIssuerToken(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func newTestContextData() CommonContextData {
+	return CommonContextData{
+		Manager: &app.VMManager{
+			Users:       app.NewUserRegistry(nil),
+			Revocations: app.NewRevocationList(nil),
+		},
+		SecretKey: "test-secret",
+		Tokens:    config.TokenConfig{AccessTTL: time.Hour, RefreshTTL: time.Hour, UserTTL: time.Hour},
+	}
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/me", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func newTestOIDC(issuer *fakeIssuer) *OIDCAuthenticator {
+	return NewOIDCAuthenticator(config.OIDCConfig{
+		Issuer:        issuer.URL,
+		Audience:      testAudience,
+		UsernameClaim: "preferred_username",
+	})
+}
+
+func TestOIDCValidToken(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	key := issuer.addKey(t, "k1")
+	data := newTestContextData()
+
+	authenticators := []Authenticator{UserJwt{}, newTestOIDC(issuer)}
+	token := signIssuerToken(t, key, "k1", issuer.claims())
+
+	principal, err := authenticate(authenticators, bearerRequest(token), data)
+	if err != nil {
+		t.Fatalf("authenticate: %v", err)
+	}
+	user, err := data.Manager.Users.Get(principal.User)
+	if err != nil {
+		t.Fatalf("user of the token was not made: %v", err)
+	}
+	if user.Name != "alice" || user.External != issuer.URL+"|user-1" {
+		t.Fatalf("unexpected user %+v", user)
+	}
+
+	again, err := authenticate(authenticators, bearerRequest(token), data)
+	if err != nil {
+		t.Fatalf("second authenticate: %v", err)
+	}
+	if again.User != principal.User {
+		t.Fatalf("second token got user %s, want %s", again.User, principal.User)
+	}
+	if issuer.fetches() != 1 {
+		t.Fatalf("jwks fetched %d times, want 1", issuer.fetches())
+	}
+}
+
+func TestOIDCRejectedTokens(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	key := issuer.addKey(t, "k1")
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		key    *rsa.PrivateKey
+		change func(jwt.MapClaims)
+	}{
+		{name: "wrong audience", key: key, change: func(c jwt.MapClaims) { c["aud"] = "someone-else" }},
+		{name: "wrong issuer", key: key, change: func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }},
+		{name: "expired", key: key, change: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		{name: "no expiry", key: key, change: func(c jwt.MapClaims) { delete(c, "exp") }},
+		{name: "no subject", key: key, change: func(c jwt.MapClaims) { delete(c, "sub") }},
+		{name: "bad signature", key: other, change: func(jwt.MapClaims) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := newTestContextData()
+			claims := issuer.claims()
+			tt.change(claims)
+			token := signIssuerToken(t, tt.key, "k1", claims)
+
+			_, err := newTestOIDC(issuer).Authenticate(bearerRequest(token), data)
+			if err == nil || errors.Is(err, ErrNoCredentials) {
+				t.Fatalf("error = %v, want the token rejected", err)
+			}
+		})
+	}
+}
+
+func TestOIDCLeavesOtherTokens(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	hs := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "x"})
+	signed, err := hs.SignedString([]byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTestOIDC(issuer)
+	for _, r := range []*http.Request{bearerRequest(signed), httptest.NewRequest(http.MethodGet, "/me", nil)} {
+		_, err := a.Authenticate(r, newTestContextData())
+		if !errors.Is(err, ErrNoCredentials) {
+			t.Fatalf("error = %v, want ErrNoCredentials", err)
+		}
+	}
+	if issuer.fetches() != 0 {
+		t.Fatalf("jwks fetched %d times, want 0", issuer.fetches())
+	}
+}
+
+func TestOIDCUnknownKid(t *testing.T) {
+	issuer := newFakeIssuer(t)
+	k1 := issuer.addKey(t, "k1")
+	data := newTestContextData()
+	a := newTestOIDC(issuer)
+
+	_, err := a.Authenticate(bearerRequest(signIssuerToken(t, k1, "k1", issuer.claims())), data)
+	if err != nil {
+		t.Fatalf("authenticate with k1: %v", err)
+	}
+
+	// the issuer rotates in a new key, which is not fetched again within
+	// jwksRefetchInterval of the last fetch
+	k2 := issuer.addKey(t, "k2")
+	k2Token := signIssuerToken(t, k2, "k2", issuer.claims())
+	_, err = a.Authenticate(bearerRequest(k2Token), data)
+	if err == nil {
+		t.Fatal("unknown kid accepted within the refetch interval")
+	}
+	if issuer.fetches() != 1 {
+		t.Fatalf("jwks fetched %d times within the refetch interval, want 1", issuer.fetches())
+	}
+
+	a.mutex.Lock()
+	a.fetchedAt = time.Now().Add(-jwksRefetchInterval)
+	a.mutex.Unlock()
+
+	_, err = a.Authenticate(bearerRequest(k2Token), data)
+	if err != nil {
+		t.Fatalf("authenticate with k2 after the refetch interval: %v", err)
+	}
+	if issuer.fetches() != 2 {
+		t.Fatalf("jwks fetched %d times, want 2", issuer.fetches())
+	}
+
+	// a kid the issuer does not have is not fetched again right away either
+	for range 3 {
+		_, err = a.Authenticate(bearerRequest(signIssuerToken(t, k2, "k3", issuer.claims())), data)
+		if err == nil {
+			t.Fatal("kid unknown to the issuer accepted")
+		}
+	}
+	if issuer.fetches() != 2 {
+		t.Fatalf("jwks fetched %d times for an unknown kid, want 2", issuer.fetches())
+	}
+}
+
+func TestTrustedHeader(t *testing.T) {
+	_, trusted, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := TrustedHeader{config.TrustedHeaderConfig{Header: "X-Forwarded-User", TrustedProxies: []*net.IPNet{trusted}}}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		user       string
+		wantErr    bool
+		noCreds    bool
+	}{
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:4000", user: "alice"},
+		{name: "untrusted address", remoteAddr: "192.0.2.1:4000", user: "alice", wantErr: true},
+		{name: "untrusted ipv6 address", remoteAddr: "[2001:db8::1]:4000", user: "alice", wantErr: true},
+		{name: "no header", remoteAddr: "10.1.2.3:4000", noCreds: true},
+		{name: "blank header", remoteAddr: "192.0.2.1:4000", user: "  ", noCreds: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := newTestContextData()
+			r := httptest.NewRequest(http.MethodGet, "/me", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.user != "" {
+				r.Header.Set("X-Forwarded-User", tt.user)
+			}
+
+			principal, err := a.Authenticate(r, data)
+			switch {
+			case tt.noCreds:
+				if !errors.Is(err, ErrNoCredentials) {
+					t.Fatalf("error = %v, want ErrNoCredentials", err)
+				}
+			case tt.wantErr:
+				if err == nil || errors.Is(err, ErrNoCredentials) {
+					t.Fatalf("error = %v, want the header rejected", err)
+				}
+			default:
+				if err != nil {
+					t.Fatalf("authenticate: %v", err)
+				}
+				user, err := data.Manager.Users.Get(principal.User)
+				if err != nil || user.Name != tt.user {
+					t.Fatalf("got user %+v, %v, want %s", user, err, tt.user)
+				}
+			}
+		})
+	}
+}
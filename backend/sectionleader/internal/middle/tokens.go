@@ -0,0 +1,262 @@
+package middle
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
+)
+
+// scopes of machine tokens, each route of /private needs one of them
+const (
+	ScopeSshKeyRead     = "ssh-key:read"
+	ScopeMachineRead    = "machine:read"    // status and ports
+	ScopeMachineStop    = "machine:stop"    // stop and delete
+	ScopeMachineControl = "machine:control" // pause, resume, wake, renew and snapshots
+	ScopePortsWrite     = "ports:write"
+	ScopeTokensWrite    = "tokens:write" // mint narrower tokens and revoke other tokens
+)
+
+// AllScopes are the scopes of the tokens handed out on create.
+var AllScopes = []string{
+	ScopeSshKeyRead,
+	ScopeMachineRead,
+	ScopeMachineStop,
+	ScopeMachineControl,
+	ScopePortsWrite,
+	ScopeTokensWrite,
+}
+
+// every token is only accepted where its audience is expected, so a refresh
+// token can't be used as an access token and a user token can't act on a
+// machine
+const (
+	audienceMachine = "nimbus:machine"
+	audienceRefresh = "nimbus:refresh"
+	audienceUser    = "nimbus:user"
+)
+
+var (
+	ErrInvalidToken  = errors.New("invalid token")
+	ErrInvalidScope  = errors.New("unknown scope")
+	ErrScopeNotHeld  = errors.New("token does not hold the scope")
+	ErrTokenRevoked  = errors.New("token has been revoked")
+	ErrNotOwnedToken = errors.New("token is not one of this machine")
+)
+
+// TokenClaims are the claims of every token the server signs. Scope holds the
+// scopes of a machine token separated by spaces, like OAuth does.
+type TokenClaims struct {
+	MachineId string `json:"machineId,omitempty"`
+	UserId    string `json:"userId,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func (c *TokenClaims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+func (c *TokenClaims) HasScope(scope string) bool {
+	return slices.Contains(c.Scopes(), scope)
+}
+
+// MachineTokens are handed out for a machine. RefreshToken is empty for
+// tokens minted from another token, they can't be refreshed.
+type MachineTokens struct {
+	Token          string    `json:"token"`
+	TokenExpiresAt time.Time `json:"token_expires_at"`
+	RefreshToken   string    `json:"refresh_token,omitempty"`
+	Scopes         []string  `json:"scopes"`
+}
+
+// NewMachineTokens signs an access token and a refresh token for a machine.
+func NewMachineTokens(id app.MachineUUID, scopes []string, data CommonContextData) (MachineTokens, error) {
+	err := checkScopes(scopes)
+	if err != nil {
+		return MachineTokens{}, err
+	}
+
+	access := newClaims(audienceMachine, data.Tokens.AccessTTL)
+	access.MachineId = id.String()
+	access.Scope = strings.Join(scopes, " ")
+	accessStr, err := signToken(access, data.SecretKey)
+	if err != nil {
+		return MachineTokens{}, err
+	}
+
+	refresh := newClaims(audienceRefresh, data.Tokens.RefreshTTL)
+	refresh.MachineId = access.MachineId
+	refresh.Scope = access.Scope
+	refreshStr, err := signToken(refresh, data.SecretKey)
+	if err != nil {
+		return MachineTokens{}, err
+	}
+
+	return MachineTokens{
+		Token:          accessStr,
+		TokenExpiresAt: access.ExpiresAt.Time,
+		RefreshToken:   refreshStr,
+		Scopes:         scopes,
+	}, nil
+}
+
+// NewScopedToken signs an access token with some of the scopes of parent. It
+// lasts at most ttl, never outlives parent and can't be refreshed.
+func NewScopedToken(parent *TokenClaims, scopes []string, ttl time.Duration, data CommonContextData) (MachineTokens, error) {
+	err := checkScopes(scopes)
+	if err != nil {
+		return MachineTokens{}, err
+	}
+	for _, scope := range scopes {
+		if !parent.HasScope(scope) {
+			return MachineTokens{}, fmt.Errorf("%w: %s", ErrScopeNotHeld, scope)
+		}
+	}
+
+	if ttl <= 0 || ttl > data.Tokens.AccessTTL {
+		ttl = data.Tokens.AccessTTL
+	}
+	claims := newClaims(audienceMachine, ttl)
+	if claims.ExpiresAt.After(parent.ExpiresAt.Time) {
+		claims.ExpiresAt = parent.ExpiresAt
+	}
+	claims.MachineId = parent.MachineId
+	claims.Scope = strings.Join(scopes, " ")
+
+	tokenStr, err := signToken(claims, data.SecretKey)
+	if err != nil {
+		return MachineTokens{}, err
+	}
+	return MachineTokens{Token: tokenStr, TokenExpiresAt: claims.ExpiresAt.Time, Scopes: scopes}, nil
+}
+
+// RefreshMachineTokens trades a refresh token for a new pair with the same
+// scopes. The refresh token is revoked, each one is good for a single use.
+func RefreshMachineTokens(refreshToken string, data CommonContextData) (MachineTokens, error) {
+	claims, err := parseToken(refreshToken, audienceRefresh, data)
+	if err != nil {
+		return MachineTokens{}, err
+	}
+
+	id, err := uuid.Parse(claims.MachineId)
+	if err != nil {
+		return MachineTokens{}, err
+	}
+	_, err = data.Manager.MachineOwner(app.MachineUUID(id))
+	if err != nil {
+		return MachineTokens{}, err
+	}
+
+	err = RevokeClaims(claims, data)
+	if errors.Is(err, app.ErrAlreadyRevoked) {
+		return MachineTokens{}, ErrTokenRevoked
+	}
+	if err != nil {
+		return MachineTokens{}, err
+	}
+	return NewMachineTokens(app.MachineUUID(id), claims.Scopes(), data)
+}
+
+// RevokeMachineToken revokes an access or refresh token of the machine id.
+// Tokens that already expired are left alone.
+func RevokeMachineToken(tokenString string, id app.MachineUUID, data CommonContextData) error {
+	claims, err := parseToken(tokenString, audienceMachine, data)
+	if errors.Is(err, jwt.ErrTokenInvalidAudience) {
+		claims, err = parseToken(tokenString, audienceRefresh, data)
+	}
+	if errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, ErrTokenRevoked) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	if claims.MachineId != id.String() {
+		return ErrNotOwnedToken
+	}
+
+	err = RevokeClaims(claims, data)
+	if errors.Is(err, app.ErrAlreadyRevoked) {
+		return nil
+	}
+	return err
+}
+
+// RevokeClaims revokes the token the claims were parsed from.
+func RevokeClaims(claims *TokenClaims, data CommonContextData) error {
+	return data.Manager.Revocations.Revoke(claims.ID, claims.ExpiresAt.Time)
+}
+
+// NewUserJwt is the token handed out on login, it identifies the user and
+// none of their machines.
+func NewUserJwt(id app.UserUUID, data CommonContextData) (string, time.Time, error) {
+	claims := newClaims(audienceUser, data.Tokens.UserTTL)
+	claims.UserId = id.String()
+
+	tokenStr, err := signToken(claims, data.SecretKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tokenStr, claims.ExpiresAt.Time, nil
+}
+
+func newClaims(audience string, ttl time.Duration) TokenClaims {
+	now := time.Now()
+	return TokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			ID:        uuid.NewString(),
+		},
+	}
+}
+
+func signToken(claims TokenClaims, secretKey string) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(secretKey))
+}
+
+// parseToken checks the signature, audience, expiry and revocation of a
+// token. Tokens signed before they had an expiry are rejected.
+func parseToken(tokenString string, audience string, data CommonContextData) (*TokenClaims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+
+	claims := &TokenClaims{}
+	_, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+		return []byte(data.SecretKey), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ID == "" {
+		return nil, fmt.Errorf("token has no id")
+	}
+	if data.Manager.Revocations.IsRevoked(claims.ID) {
+		return nil, ErrTokenRevoked
+	}
+	return claims, nil
+}
+
+func checkScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: at least one scope is needed", ErrInvalidScope)
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(AllScopes, scope) {
+			return fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package middle
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
+)
+
+// newTestMachine adds a machine to the manager of data, so that its tokens
+// can be refreshed.
+func newTestMachine(data CommonContextData) app.MachineUUID {
+	id := app.MachineUUID(uuid.New())
+	if data.Manager.VMs == nil {
+		data.Manager.VMs = make(map[app.MachineUUID]*app.VM)
+	}
+	data.Manager.VMs[id] = &app.VM{Id: id}
+	return id
+}
+
+func checkJwtStatus(data CommonContextData, token string) int {
+	handler := WithData(data, CheckJwt(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, bearerRequest(token))
+	return w.Code
+}
+
+func TestTokenAudiences(t *testing.T) {
+	data := newTestContextData()
+	id := newTestMachine(data)
+
+	tokens, err := NewMachineTokens(id, AllScopes, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userToken, _, err := NewUserJwt(app.UserUUID(uuid.New()), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	principal, err := MachineJwt{}.Authenticate(bearerRequest(tokens.Token), data)
+	if err != nil {
+		t.Fatalf("access token: %v", err)
+	}
+	if principal.Machine.MachineId != id.String() {
+		t.Fatalf("access token is of machine %s, want %s", principal.Machine.MachineId, id)
+	}
+
+	tests := []struct {
+		name          string
+		authenticator Authenticator
+		token         string
+	}{
+		{name: "refresh token as access token", authenticator: MachineJwt{}, token: tokens.RefreshToken},
+		{name: "user token as access token", authenticator: MachineJwt{}, token: userToken},
+		{name: "access token as user token", authenticator: UserJwt{}, token: tokens.Token},
+		{name: "refresh token as user token", authenticator: UserJwt{}, token: tokens.RefreshToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.authenticator.Authenticate(bearerRequest(tt.token), data)
+			if err == nil || errors.Is(err, ErrNoCredentials) {
+				t.Fatalf("error = %v, want the token rejected", err)
+			}
+		})
+	}
+
+	if code := checkJwtStatus(data, tokens.RefreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("CheckJwt with a refresh token = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := checkJwtStatus(data, userToken); code != http.StatusUnauthorized {
+		t.Fatalf("CheckJwt with a user token = %d, want %d", code, http.StatusUnauthorized)
+	}
+}
+
+func TestTokenWrongSecret(t *testing.T) {
+	data := newTestContextData()
+	id := newTestMachine(data)
+
+	tokens, err := NewMachineTokens(id, AllScopes, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.SecretKey = "another-secret"
+	_, err = MachineJwt{}.Authenticate(bearerRequest(tokens.Token), data)
+	if err == nil {
+		t.Fatal("token signed with another secret accepted")
+	}
+}
+
+func TestScopedToken(t *testing.T) {
+	data := newTestContextData()
+	id := newTestMachine(data)
+
+	tokens, err := NewMachineTokens(id, []string{ScopeMachineRead, ScopeSshKeyRead, ScopeTokensWrite}, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, err := parseToken(tokens.Token, audienceMachine, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	child, err := NewScopedToken(parent, []string{ScopeMachineRead}, time.Minute, data)
+	if err != nil {
+		t.Fatalf("narrower token: %v", err)
+	}
+	if child.RefreshToken != "" {
+		t.Fatal("scoped token came with a refresh token")
+	}
+	claims, err := parseToken(child.Token, audienceMachine, data)
+	if err != nil {
+		t.Fatalf("parse scoped token: %v", err)
+	}
+	if claims.MachineId != id.String() || !claims.HasScope(ScopeMachineRead) || claims.HasScope(ScopeSshKeyRead) {
+		t.Fatalf("unexpected scoped claims %+v", claims)
+	}
+
+	_, err = NewScopedToken(parent, []string{ScopeMachineRead, ScopeMachineStop}, time.Minute, data)
+	if !errors.Is(err, ErrScopeNotHeld) {
+		t.Fatalf("wider token error = %v, want ErrScopeNotHeld", err)
+	}
+	_, err = NewScopedToken(parent, []string{"machine:everything"}, time.Minute, data)
+	if !errors.Is(err, ErrInvalidScope) {
+		t.Fatalf("unknown scope error = %v, want ErrInvalidScope", err)
+	}
+	_, err = NewScopedToken(parent, nil, time.Minute, data)
+	if !errors.Is(err, ErrInvalidScope) {
+		t.Fatalf("no scope error = %v, want ErrInvalidScope", err)
+	}
+
+	// a parent about to expire caps the expiry of the tokens minted from it
+	parent.ExpiresAt.Time = time.Now().Add(5 * time.Minute).Truncate(time.Second)
+	for _, ttl := range []time.Duration{30 * time.Minute, 0, 24 * time.Hour} {
+		child, err = NewScopedToken(parent, []string{ScopeMachineRead}, ttl, data)
+		if err != nil {
+			t.Fatalf("scoped token for %v: %v", ttl, err)
+		}
+		claims, err = parseToken(child.Token, audienceMachine, data)
+		if err != nil {
+			t.Fatalf("parse scoped token: %v", err)
+		}
+		if claims.ExpiresAt.After(parent.ExpiresAt.Time) {
+			t.Fatalf("token for %v expires at %v, after its parent at %v", ttl, claims.ExpiresAt.Time, parent.ExpiresAt.Time)
+		}
+	}
+}
+
+func TestRefreshMachineTokens(t *testing.T) {
+	data := newTestContextData()
+	id := newTestMachine(data)
+
+	scopes := []string{ScopeMachineRead, ScopePortsWrite}
+	tokens, err := NewMachineTokens(id, scopes, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := RefreshMachineTokens(tokens.RefreshToken, data)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	claims, err := parseToken(refreshed.Token, audienceMachine, data)
+	if err != nil {
+		t.Fatalf("refreshed access token: %v", err)
+	}
+	if claims.Scope != "machine:read ports:write" {
+		t.Fatalf("refreshed token has scopes %q", claims.Scope)
+	}
+
+	_, err = RefreshMachineTokens(tokens.RefreshToken, data)
+	if !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("second refresh error = %v, want ErrTokenRevoked", err)
+	}
+
+	_, err = RefreshMachineTokens(refreshed.Token, data)
+	if err == nil {
+		t.Fatal("access token accepted as a refresh token")
+	}
+
+	delete(data.Manager.VMs, id)
+	_, err = RefreshMachineTokens(refreshed.RefreshToken, data)
+	if !errors.Is(err, app.ErrMachineNotFound) {
+		t.Fatalf("refresh of a deleted machine error = %v, want ErrMachineNotFound", err)
+	}
+}
+
+func TestRevokeMachineToken(t *testing.T) {
+	data := newTestContextData()
+	id := newTestMachine(data)
+	other := newTestMachine(data)
+
+	tokens, err := NewMachineTokens(id, AllScopes, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := checkJwtStatus(data, tokens.Token); code != http.StatusOK {
+		t.Fatalf("CheckJwt before revoking = %d, want %d", code, http.StatusOK)
+	}
+
+	err = RevokeMachineToken(tokens.Token, other, data)
+	if !errors.Is(err, ErrNotOwnedToken) {
+		t.Fatalf("revoke through another machine error = %v, want ErrNotOwnedToken", err)
+	}
+	err = RevokeMachineToken("not a token", id, data)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("revoke of garbage error = %v, want ErrInvalidToken", err)
+	}
+
+	err = RevokeMachineToken(tokens.Token, id, data)
+	if err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if code := checkJwtStatus(data, tokens.Token); code != http.StatusUnauthorized {
+		t.Fatalf("CheckJwt after revoking = %d, want %d", code, http.StatusUnauthorized)
+	}
+	err = RevokeMachineToken(tokens.Token, id, data)
+	if err != nil {
+		t.Fatalf("revoking twice: %v", err)
+	}
+
+	err = RevokeMachineToken(tokens.RefreshToken, id, data)
+	if err != nil {
+		t.Fatalf("revoke refresh token: %v", err)
+	}
+	_, err = RefreshMachineTokens(tokens.RefreshToken, data)
+	if !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("refresh with a revoked token error = %v, want ErrTokenRevoked", err)
+	}
+}
@@ -5,15 +5,22 @@ import (
 	"net/http"
 
 	"github.com/tongshengw/nimbus/backend/sectionleader/internal/app"
+	"github.com/tongshengw/nimbus/backend/sectionleader/internal/config"
 )
 
 type ContextKey string
 const CommonContextDataKey ContextKey = "request-data"
 const MachineIdContextDataKey ContextKey = "user-machine-id"
+const UserIdContextDataKey ContextKey = "user-id"
+const TokenClaimsContextDataKey ContextKey = "token-claims"
+const AdminKeyContextDataKey ContextKey = "admin-key"
 
 type CommonContextData struct {
 	Manager *app.VMManager
 	SecretKey string
+	Tokens config.TokenConfig
+	// tried in order on the routes of users
+	UserAuth []Authenticator
 }
 
 func WithData(data CommonContextData, next http.Handler) http.Handler {
@@ -0,0 +1,98 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// migrations are applied in order, each in its own transaction. The schema
+// version stored in the meta bucket is the number of migrations applied. Only
+// ever append to this list.
+var migrations = []func(tx *bolt.Tx) error{
+	// 1: initial buckets
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucketMachines))
+		return err
+	},
+	// 2: port allocations, keyed by <pool>/<port>
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BucketPorts))
+		return err
+	},
+	// 3: subnet allocations keyed by cidr, replacing the next subnet counter
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BucketSubnets))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(bucketMeta)).Delete([]byte("cni_next_subnet"))
+	},
+	// 4: user accounts keyed by user id
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BucketUsers))
+		return err
+	},
+	// 5: ids of revoked tokens, with when they expire
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BucketRevoked))
+		return err
+	},
+	// 6: hashed admin API keys keyed by key id
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(BucketAdminKeys))
+		return err
+	},
+}
+
+func (s *Store) migrate() error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(bucketMeta))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	version, err := s.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("db schema version %d is newer than this build supports (%d)", version, len(migrations))
+	}
+
+	for i := version; i < len(migrations); i++ {
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			err := migrations[i](tx)
+			if err != nil {
+				return err
+			}
+			return tx.Bucket([]byte(bucketMeta)).Put([]byte(keySchemaVersion), []byte(strconv.Itoa(i+1)))
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d failed: %v", i+1, err)
+		}
+		logrus.Infof("applied db migration %d", i+1)
+	}
+
+	return nil
+}
+
+func (s *Store) schemaVersion() (int, error) {
+	value, err := s.GetMeta(keySchemaVersion)
+	if err != nil {
+		return 0, err
+	}
+	if value == nil {
+		return 0, nil
+	}
+
+	version, err := strconv.Atoi(string(value))
+	if err != nil {
+		return 0, fmt.Errorf("malformed schema version %q", value)
+	}
+	return version, nil
+}
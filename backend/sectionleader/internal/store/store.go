@@ -0,0 +1,120 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	bucketMeta      = "meta"
+	bucketMachines  = "machines"
+	BucketPorts     = "ports"
+	BucketSubnets   = "subnets"
+	BucketUsers     = "users"
+	BucketRevoked   = "revoked_tokens"
+	BucketAdminKeys = "admin_keys"
+
+	keySchemaVersion = "schema_version"
+)
+
+// Store is an embedded bbolt database holding the sectionleader state that
+// has to survive a restart. Values are opaque bytes, the caller owns the
+// encoding.
+type Store struct {
+	db *bolt.DB
+}
+
+func Open(path string) (*Store, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, fmt.Errorf("open db %s: %v", path, err)
+	}
+
+	s := &Store{db: db}
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	logrus.Infof("opened store at %s", path)
+	return s, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) PutMachine(id string, value []byte) error {
+	return s.put(bucketMachines, id, value)
+}
+
+func (s *Store) DeleteMachine(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucketMachines)).Delete([]byte(id))
+	})
+}
+
+// ListMachines returns every stored machine keyed by id.
+func (s *Store) ListMachines() (map[string][]byte, error) {
+	return s.list(bucketMachines)
+}
+
+// GetMeta returns nil if the key has never been set.
+func (s *Store) GetMeta(key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(bucketMeta)).Get([]byte(key))
+		if v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *Store) PutMeta(key string, value []byte) error {
+	return s.put(bucketMeta, key, value)
+}
+
+// Put, Delete and List give access to the buckets without a typed wrapper.
+func (s *Store) Put(bucket string, key string, value []byte) error {
+	return s.put(bucket, key, value)
+}
+
+func (s *Store) Delete(bucket string, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Delete([]byte(key))
+	})
+}
+
+func (s *Store) List(bucket string) (map[string][]byte, error) {
+	return s.list(bucket)
+}
+
+func (s *Store) put(bucket string, key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put([]byte(key), value)
+	})
+}
+
+func (s *Store) list(bucket string) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+			values[string(k)] = append([]byte{}, v...)
+			return nil
+		})
+	})
+	return values, err
+}
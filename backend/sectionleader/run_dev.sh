@@ -1,14 +1,7 @@
 #!/bin/bash
+# leftover VMs, veths, CNI configs, forwarding rules, ingress configs and _data
+# directories are cleaned up by the reconciler when the server starts
 rm -f server.log
-sudo rm -rf /home/tswu/frpc/nimbus
-sudo mkdir /home/tswu/frpc/nimbus
-sudo rm -rf _data/
-sudo rm -rf /var/lib/cni/networks
-sudo rm -rf /etc/cni/conf.d
-
-for iface in $(ip -o link show | awk -F': ' '{print $2}' | cut -d@ -f1 | grep 'veth'); do
-    sudo ip link delete "$iface"
-done
 
 make
-#sudo ./server-sectionleader
\ No newline at end of file
+#sudo ./server-sectionleader